@@ -19,6 +19,7 @@ import (
 	"github.com/fleetdm/fleet/v4/server/contexts/license"
 	"github.com/fleetdm/fleet/v4/server/datastore/mysql"
 	"github.com/fleetdm/fleet/v4/server/fleet"
+	"github.com/fleetdm/fleet/v4/server/live_query"
 	"github.com/fleetdm/fleet/v4/server/mdm"
 	apple_mdm "github.com/fleetdm/fleet/v4/server/mdm/apple"
 	"github.com/fleetdm/fleet/v4/server/mdm/assets"
@@ -794,6 +795,7 @@ func newCleanupsAndAggregationSchedule(
 	ctx context.Context,
 	instanceID string,
 	ds fleet.Datastore,
+	lq fleet.LiveQueryStore,
 	logger kitlog.Logger,
 	enrollHostLimiter fleet.EnrollHostLimiter,
 	config *config.FleetConfig,
@@ -818,6 +820,19 @@ func newCleanupsAndAggregationSchedule(
 				return err
 			},
 		),
+		schedule.WithJob(
+			"redis_live_queries_repair",
+			func(ctx context.Context) error {
+				// Scans the whole keyspace, so it runs here instead of with the
+				// redis_live_queries job of the frequent cleanups.
+				_, _, err := lq.RepairActiveQueries(ctx)
+				if errors.Is(err, live_query.ErrReadOnly) {
+					// the store does not modify the live queries while it is read-only
+					return nil
+				}
+				return err
+			},
+		),
 		schedule.WithJob(
 			"incoming_hosts",
 			func(ctx context.Context) error {
@@ -1003,6 +1018,10 @@ func newFrequentCleanupsSchedule(
 					return err
 				}
 				err = lq.CleanupInactiveQueries(ctx, completed)
+				if errors.Is(err, live_query.ErrReadOnly) {
+					// the store does not modify the live queries while it is read-only
+					return nil
+				}
 				return err
 			},
 		),
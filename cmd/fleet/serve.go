@@ -77,6 +77,9 @@ var allowedURLPrefixRegexp = regexp.MustCompile("^(?:/[a-zA-Z0-9_.~-]+)+$")
 
 const (
 	liveQueryMemCacheDuration = 1 * time.Second
+	// how long the Redis memory usage is cached when
+	// redis.live_query_memory_high_water_mark is set.
+	liveQueryMemoryUsageCacheDuration = 5 * time.Second
 )
 
 type initializer interface {
@@ -352,7 +355,29 @@ the way that the Fleet server works.
 			resultStore := pubsub.NewRedisQueryResults(redisPool, config.Redis.DuplicateResults,
 				log.With(logger, "component", "query-results"),
 			)
-			liveQueryStore := live_query.NewRedisLiveQuery(redisPool, logger, liveQueryMemCacheDuration)
+			liveQueryOpts := []live_query.Option{
+				live_query.WithMaxSQLLength(config.Redis.LiveQueryMaxSQLLength),
+				live_query.WithBitfieldChunkSize(config.Redis.LiveQueryBitfieldChunkSize),
+				live_query.WithMaxQueriesPerHost(config.Redis.LiveQueryMaxQueriesPerHost),
+				live_query.WithHotQueriesReport(config.Redis.LiveQueryHotQueriesInterval, config.Redis.LiveQueryHotQueriesTopN),
+				live_query.WithResettableCompletions(config.Redis.LiveQueryResettableCompletions),
+				live_query.WithDatastoreLabels(ds),
+			}
+			switch config.Redis.LiveQueryHostQueriesCapOrder {
+			case "", "round_robin":
+				liveQueryOpts = append(liveQueryOpts, live_query.WithHostQueriesCapOrder(live_query.HostQueriesRoundRobin))
+			case "oldest_first":
+				liveQueryOpts = append(liveQueryOpts, live_query.WithHostQueriesCapOrder(live_query.HostQueriesOldestFirst))
+			default:
+				initFatal(fmt.Errorf("invalid value %q, must be round_robin or oldest_first", config.Redis.LiveQueryHostQueriesCapOrder),
+					"redis.live_query_host_queries_cap_order")
+			}
+			if config.Redis.LiveQueryMemoryHighWaterMark > 0 {
+				liveQueryOpts = append(liveQueryOpts,
+					live_query.WithMemoryHighWaterMark(uint64(config.Redis.LiveQueryMemoryHighWaterMark), liveQueryMemoryUsageCacheDuration))
+			}
+			liveQueryStore := live_query.NewRedisLiveQuery(redisPool, logger, liveQueryMemCacheDuration, liveQueryOpts...)
+			liveQueryStore.SetReadOnly(config.Redis.LiveQueryReadOnly)
 			ssoSessionStore := sso.NewSessionStore(redisPool)
 
 			// Set common configuration for all logging.
@@ -862,7 +887,7 @@ the way that the Fleet server works.
 				func() (fleet.CronSchedule, error) {
 					commander := apple_mdm.NewMDMAppleCommander(mdmStorage, mdmPushService)
 					return newCleanupsAndAggregationSchedule(
-						ctx, instanceID, ds, logger, redisWrapperDS, &config, commander, softwareInstallStore, bootstrapPackageStore,
+						ctx, instanceID, ds, liveQueryStore, logger, redisWrapperDS, &config, commander, softwareInstallStore, bootstrapPackageStore,
 					)
 				},
 			); err != nil {
@@ -979,6 +1004,10 @@ the way that the Fleet server works.
 			// StartCollectors starts a goroutine per collector, using ctx to cancel.
 			task.StartCollectors(ctx, kitlog.With(logger, "cron", "async_task"))
 
+			// Start starts the background tasks of the live query store, using ctx
+			// to cancel.
+			liveQueryStore.Start(ctx)
+
 			// Flush seen hosts every second
 			hostsAsyncCfg := config.Osquery.AsyncConfigForTask(configpkg.AsyncTaskHostLastSeen)
 			if !hostsAsyncCfg.Enabled {
@@ -1277,6 +1306,9 @@ the way that the Fleet server works.
 				defer cancel()
 				errs <- func() error {
 					cancelFunc()
+					if err := liveQueryStore.Close(ctx); err != nil {
+						level.Error(logger).Log("msg", "failed to close the live query store", "err", err)
+					}
 					cleanupCronStatsOnShutdown(ctx, ds, logger, instanceID)
 					launcher.GracefulStop()
 					return srv.Shutdown(ctx)
@@ -14,6 +14,7 @@ import (
 	kitlog "github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 )
 
@@ -84,7 +85,7 @@ func TestSavedLiveQuery(t *testing.T) {
 		return fleet.TargetMetrics{TotalHosts: 1, OnlineHosts: 1}, nil
 	}
 
-	lq.On("QueriesForHost", uint(1)).Return(
+	lq.On("QueriesForHostPlatform", uint(1), mock.Anything).Return(
 		map[string]string{
 			"42": queryString,
 		},
@@ -248,7 +249,7 @@ func TestAdHocLiveQuery(t *testing.T) {
 		return fleet.TargetMetrics{TotalHosts: 1, OnlineHosts: 1}, nil
 	}
 
-	lq.On("QueriesForHost", uint(1)).Return(
+	lq.On("QueriesForHostPlatform", uint(1), mock.Anything).Return(
 		map[string]string{
 			"42": "select 42, * from time",
 		},
@@ -74,6 +74,16 @@ type RedisConfig struct {
 	ConnWaitTimeout time.Duration `yaml:"conn_wait_timeout"`
 	WriteTimeout    time.Duration `yaml:"write_timeout"`
 	ReadTimeout     time.Duration `yaml:"read_timeout"`
+
+	LiveQueryMaxSQLLength          int           `yaml:"live_query_max_sql_length"`
+	LiveQueryBitfieldChunkSize     int           `yaml:"live_query_bitfield_chunk_size"`
+	LiveQueryMaxQueriesPerHost     int           `yaml:"live_query_max_queries_per_host"`
+	LiveQueryHostQueriesCapOrder   string        `yaml:"live_query_host_queries_cap_order"`
+	LiveQueryMemoryHighWaterMark   int           `yaml:"live_query_memory_high_water_mark"`
+	LiveQueryHotQueriesInterval    time.Duration `yaml:"live_query_hot_queries_interval"`
+	LiveQueryHotQueriesTopN        int           `yaml:"live_query_hot_queries_top_n"`
+	LiveQueryResettableCompletions bool          `yaml:"live_query_resettable_completions"`
+	LiveQueryReadOnly              bool          `yaml:"live_query_read_only"`
 }
 
 const (
@@ -970,6 +980,15 @@ func (man Manager) addConfigs() {
 	man.addConfigDuration("redis.conn_wait_timeout", 0, "Redis maximum amount of time to wait for a connection if the maximum is reached (0 for no wait)")
 	man.addConfigDuration("redis.write_timeout", 10*time.Second, "Redis maximum amount of time to wait for a write (send) on a connection")
 	man.addConfigDuration("redis.read_timeout", 10*time.Second, "Redis maximum amount of time to wait for a read (receive) on a connection")
+	man.addConfigInt("redis.live_query_max_sql_length", 1<<20, "Maximum length in bytes of the SQL of a live query, 0 means no limit")
+	man.addConfigInt("redis.live_query_bitfield_chunk_size", 0, "Number of hosts per chunk of the live query targets bitfield, 0 means a single bitfield (must be the same on all Fleet instances)")
+	man.addConfigInt("redis.live_query_max_queries_per_host", 0, "Maximum number of live queries returned to a host on a check-in, 0 means no limit")
+	man.addConfigString("redis.live_query_host_queries_cap_order", "round_robin", "Order of the live queries returned to a host over the cap (round_robin or oldest_first)")
+	man.addConfigInt("redis.live_query_memory_high_water_mark", 0, "Redis memory usage in bytes over which new live queries are rejected, 0 means no limit")
+	man.addConfigDuration("redis.live_query_hot_queries_interval", 0, "Interval between the logs of the most requested live queries, 0 disables the report")
+	man.addConfigInt("redis.live_query_hot_queries_top_n", 10, "Number of live queries in the report of the most requested ones")
+	man.addConfigBool("redis.live_query_resettable_completions", false, "Record the live query completions so that they can be reset when a host re-enrolls (must be the same on all Fleet instances)")
+	man.addConfigBool("redis.live_query_read_only", false, "Reject the live query changes (e.g. during a Redis failover), running queries are still returned to the hosts")
 
 	// Server
 	man.addConfigString("server.address", "0.0.0.0:8080",
@@ -1390,6 +1409,16 @@ func (man Manager) LoadConfig() FleetConfig {
 			ConnWaitTimeout:           man.getConfigDuration("redis.conn_wait_timeout"),
 			WriteTimeout:              man.getConfigDuration("redis.write_timeout"),
 			ReadTimeout:               man.getConfigDuration("redis.read_timeout"),
+
+			LiveQueryMaxSQLLength:          man.getConfigInt("redis.live_query_max_sql_length"),
+			LiveQueryBitfieldChunkSize:     man.getConfigInt("redis.live_query_bitfield_chunk_size"),
+			LiveQueryMaxQueriesPerHost:     man.getConfigInt("redis.live_query_max_queries_per_host"),
+			LiveQueryHostQueriesCapOrder:   man.getConfigString("redis.live_query_host_queries_cap_order"),
+			LiveQueryMemoryHighWaterMark:   man.getConfigInt("redis.live_query_memory_high_water_mark"),
+			LiveQueryHotQueriesInterval:    man.getConfigDuration("redis.live_query_hot_queries_interval"),
+			LiveQueryHotQueriesTopN:        man.getConfigInt("redis.live_query_hot_queries_top_n"),
+			LiveQueryResettableCompletions: man.getConfigBool("redis.live_query_resettable_completions"),
+			LiveQueryReadOnly:              man.getConfigBool("redis.live_query_read_only"),
 		},
 		Server: ServerConfig{
 			Address:                     man.getConfigString("server.address"),
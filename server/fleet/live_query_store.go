@@ -1,6 +1,29 @@
 package fleet
 
-import "context"
+import (
+	"context"
+	"time"
+)
+
+// LiveQuerySpec is the specification of a live query to run with
+// LiveQueryStore.RunQueries.
+type LiveQuerySpec struct {
+	Name    string
+	SQL     string
+	HostIDs []uint
+}
+
+// LiveQueryInfo is a live query as returned by
+// LiveQueryStore.QueriesForHostWithMeta.
+type LiveQueryInfo struct {
+	SQL string
+	// CreatedAt is the time when the query was started, it is the zero time if
+	// unknown.
+	CreatedAt time.Time
+	// PendingHosts is the number of targeted hosts that did not complete the
+	// query yet.
+	PendingHosts int64
+}
 
 // LiveQueryStore defines an interface for storing and retrieving the status of
 // live queries in the Fleet system.
@@ -8,20 +31,90 @@ type LiveQueryStore interface {
 	// RunQuery starts a query with the given name and SQL, targeting the
 	// provided host IDs.
 	RunQuery(name, sql string, hostIDs []uint) error
+	// RunQueryContext is like RunQuery, but the store operations are bounded
+	// by ctx so that they can be cancelled or time out.
+	RunQueryContext(ctx context.Context, name, sql string, hostIDs []uint) error
+	// RunQueries starts multiple queries at once. The store does it in a
+	// single batch where possible, and if it cannot guarantee that either all
+	// or none of the queries are started, the error reports which ones failed.
+	RunQueries(ctx context.Context, queries []LiveQuerySpec) error
+	// RunQueryWithTTL is like RunQueryContext, but the query expires after ttl
+	// so that it does not linger if its campaign is lost. It is a backstop
+	// for CleanupInactiveQueries, not a replacement. QueriesForHost does not
+	// return the expired queries.
+	RunQueryWithTTL(ctx context.Context, name, sql string, hostIDs []uint, ttl time.Duration) error
+	// RunQueryWithPriority is like RunQueryContext, but when a host is
+	// targeted by more queries than the store returns at once, the queries
+	// with a higher priority are returned first. RunQuery uses priority 0.
+	RunQueryWithPriority(ctx context.Context, name, sql string, hostIDs []uint, priority int) error
+	// ReplaceQuery is like RunQueryContext, but it overwrites the query with
+	// the same name if it is already running, while the RunQuery methods
+	// fail in that case.
+	ReplaceQuery(ctx context.Context, name, sql string, hostIDs []uint) error
 	// StopQuery stops a running query with the given name. Hosts will no longer
 	// receive the query after StopQuery has been called.
 	StopQuery(name string) error
+	// StopQueries stops multiple queries at once. The names that are not
+	// running are ignored, and if the store cannot guarantee that either all
+	// or none of the queries are stopped, the error reports which ones failed.
+	StopQueries(ctx context.Context, names []string) error
 	// QueriesForHost returns the active queries for the given host ID. The
 	// return value maps from query name to SQL.
 	QueriesForHost(hostID uint) (map[string]string, error)
+	// QueriesForHostPlatform is like QueriesForHost, but it also returns the
+	// queries restricted to the platform of the host, which QueriesForHost
+	// never returns. It is the method to use on the host check-in path.
+	QueriesForHostPlatform(hostID uint, hostPlatform string) (map[string]string, error)
+	// QueriesForHostWithMeta is like QueriesForHost, but the return value maps
+	// from query name to the SQL and the progress of the query. It is costlier
+	// than QueriesForHost and should not be used on the host check-in path. It
+	// has no side effect on the dispatch of the queries to the host.
+	QueriesForHostWithMeta(hostID uint) (map[string]LiveQueryInfo, error)
+	// QueriesForHosts is like QueriesForHost, but for multiple hosts at once.
+	// The returned map has an entry for each host, which is empty if the host
+	// has no query to run.
+	QueriesForHosts(ctx context.Context, hostIDs []uint) (map[uint]map[string]string, error)
 	// QueryCompletedByHost marks the query with the given name as completed by the
 	// given host. After calling QueryCompleted, that query will no longer be
 	// sent to the host.
 	QueryCompletedByHost(name string, hostID uint) error
+	// QueryCompletedByHostContext is like QueryCompletedByHost, but the store
+	// operations are bounded by ctx so that they can be cancelled or time out.
+	QueryCompletedByHostContext(ctx context.Context, name string, hostID uint) error
+	// QueryCompletionStats returns the number of hosts targeted by the query
+	// with the given name and the number of those that completed it.
+	QueryCompletionStats(ctx context.Context, name string) (total, completed int, err error)
+	// ResetHostQueries clears the completion of the active queries by the
+	// host with the given ID, so that the queries it completed are returned
+	// again by QueriesForHost, e.g. after it re-enrolled. The other hosts are
+	// unaffected. Depending on its configuration, the store may not record the
+	// completions of some queries, which are then not reset and an error is
+	// returned once the other queries are reset.
+	ResetHostQueries(ctx context.Context, hostID uint) error
+	// PendingHostsForQuery returns the IDs of the hosts targeted by the query
+	// with the given name that did not complete it yet. All the targets of
+	// the query are read, so it is intended for bounded campaigns.
+	PendingHostsForQuery(ctx context.Context, name string) ([]uint, error)
 	// CleanupInactiveQueries removes any inactive queries. This is used via a
 	// cron job to regularly cleanup any queries that may have failed to be
 	// stopped properly in Redis.
 	CleanupInactiveQueries(ctx context.Context, inactiveCampaignIDs []uint) error
+	// CleanupInactiveQueriesDryRun returns the names of the queries that are
+	// not the queries of the active campaigns, i.e. that a cleanup would
+	// remove, without removing them.
+	CleanupInactiveQueriesDryRun(ctx context.Context, activeCampaignIDs []uint) (removed []string, err error)
+	// RepairActiveQueries reconciles the set of the active queries with the
+	// queries actually stored, and returns the names that were added to and
+	// removed from the set. It scans the whole store, so it is used via a cron
+	// job that runs less often than CleanupInactiveQueries.
+	RepairActiveQueries(ctx context.Context) (added, removed []string, err error)
 	// LoadActiveQueryNames returns the names of all active queries.
 	LoadActiveQueryNames() ([]string, error)
+	// ActiveQueryNames returns the names of all the queries that the store is
+	// currently serving, bypassing any cache. It is meant for reconciliation
+	// and diagnostics, not for the host check-in path.
+	ActiveQueryNames(ctx context.Context) ([]string, error)
+	// QueryExists returns whether the query with the given name is currently
+	// active, without reading its SQL.
+	QueryExists(ctx context.Context, name string) (bool, error)
 }
@@ -0,0 +1,304 @@
+package live_query
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/fleetdm/fleet/v4/server/datastore/redis"
+	"github.com/fleetdm/fleet/v4/server/fleet"
+	redigo "github.com/gomodule/redigo/redis"
+	"github.com/hashicorp/go-multierror"
+)
+
+// SpecError is the error of one of the queries passed to RunQueries.
+type SpecError struct {
+	Name string
+	Err  error
+}
+
+func (e *SpecError) Error() string {
+	return fmt.Sprintf("live query %s: %s", e.Name, e.Err)
+}
+
+func (e *SpecError) Unwrap() error {
+	return e.Err
+}
+
+// RunQueries stores multiple live queries at once, as RunQuery does for each
+// of them. The queries are validated first, and if any of them is invalid or
+// already running, none is stored and the returned error is a
+// *multierror.Error with a *SpecError for each such query.
+//
+// With standalone Redis, the queries are stored in a single transaction, so
+// they are either all stored or none is. With Redis Cluster, they are stored
+// with one pipeline per cluster slot, so some queries may be stored while
+// others fail, in which case the returned error is a *multierror.Error with a
+// *SpecError for each query that failed.
+func (r *redisLiveQuery) RunQueries(ctx context.Context, queries []fleet.LiveQuerySpec) (err error) {
+	if o := r.observer; o != nil {
+		defer observe(o.ObserveRunQuery, time.Now(), &err)
+	}
+
+	if len(queries) == 0 {
+		return nil
+	}
+
+	var errs *multierror.Error
+	names := make([]string, 0, len(queries))
+	seen := make(map[string]bool, len(queries))
+	for _, q := range queries {
+		if seen[q.Name] {
+			errs = multierror.Append(errs, &SpecError{Name: q.Name, Err: errors.New("duplicate query name")})
+			continue
+		}
+		seen[q.Name] = true
+		names = append(names, q.Name)
+
+		if err := r.validateQuery(queryInfo{name: q.Name, sql: q.SQL, hostIDs: q.HostIDs}); err != nil {
+			errs = multierror.Append(errs, &SpecError{Name: q.Name, Err: err})
+		}
+	}
+	if err := errs.ErrorOrNil(); err != nil {
+		return err
+	}
+	if r.readOnly.Load() {
+		return ErrReadOnly
+	}
+	if err := r.checkMemory(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := r.nameLocks.lockAll(names)
+	defer unlock()
+
+	running, err := r.runningQueries(ctx, names)
+	if err != nil {
+		return fmt.Errorf("check running queries: %w", err)
+	}
+	for _, name := range running {
+		errs = multierror.Append(errs, &SpecError{Name: name, Err: ErrQueryAlreadyRunning})
+	}
+	if err := errs.ErrorOrNil(); err != nil {
+		return err
+	}
+
+	// see runQuery
+	defer func() {
+		for _, name := range names {
+			r.invalidateCache(name, false)
+		}
+	}()
+
+	chunkKeys, err := r.queryChunkKeys(ctx, names...)
+	if err != nil {
+		return fmt.Errorf("read previous query chunks: %w", err)
+	}
+
+	createdAt := r.clock()
+	infos := make([]queryInfo, 0, len(queries))
+	for _, q := range queries {
+		infos = append(infos, queryInfo{
+			name:      q.Name,
+			sql:       q.SQL,
+			hostIDs:   q.HostIDs,
+			createdAt: createdAt,
+			chunkSize: r.chunkSize,
+			staleKeys: chunkKeys[q.Name],
+		})
+	}
+
+	stored := infos
+	if r.pool.Mode() == fleet.RedisStandalone {
+		if err := r.storeQueriesTx(ctx, infos...); err != nil {
+			return fmt.Errorf("run queries: %w", err)
+		}
+	} else {
+		stored, errs = r.storeQueriesBySlot(ctx, infos)
+	}
+
+	for _, info := range stored {
+		r.setQueryMeta(info.name, queryMeta{createdAt: info.createdAt})
+		r.counters.targetedHosts.Add(uint64(len(info.hostIDs)))
+	}
+	return errs.ErrorOrNil()
+}
+
+// storeQueriesBySlot stores the queries with one pipeline per cluster slot,
+// and then adds the names of the stored queries to the active queries set. It
+// returns the queries that were stored and the errors of the others.
+func (r *redisLiveQuery) storeQueriesBySlot(ctx context.Context, infos []queryInfo) ([]queryInfo, *multierror.Error) {
+	var errs *multierror.Error
+
+	infosByKey := make(map[string]queryInfo, len(infos))
+	targetKeys := make([]string, 0, len(infos))
+	for _, info := range infos {
+		targetKey, _ := generateKeys(info.name)
+		infosByKey[targetKey] = info
+		targetKeys = append(targetKeys, targetKey)
+	}
+
+	var stored []queryInfo
+	for _, keys := range redis.SplitKeysBySlot(r.pool, targetKeys...) {
+		batch := make([]queryInfo, 0, len(keys))
+		for _, key := range keys {
+			batch = append(batch, infosByKey[key])
+		}
+		if err := r.storeQueryInfo(ctx, batch...); err != nil {
+			for _, info := range batch {
+				errs = multierror.Append(errs, &SpecError{Name: info.name, Err: fmt.Errorf("store query info: %w", err)})
+			}
+			continue
+		}
+		stored = append(stored, batch...)
+	}
+	if len(stored) == 0 {
+		return nil, errs
+	}
+
+	names := make([]string, 0, len(stored))
+	for _, info := range stored {
+		names = append(names, info.name)
+	}
+	// the queries that are stored but not in the active queries set are added
+	// to it by RepairActiveQueries.
+	if err := r.storeQueryNames(ctx, names...); err != nil {
+		for _, name := range names {
+			errs = multierror.Append(errs, &SpecError{Name: name, Err: fmt.Errorf("store query name: %w", err)})
+		}
+		return nil, errs
+	}
+	return stored, errs
+}
+
+// StopQueries stops multiple live queries at once, as StopQuery does for each
+// of them. The names that are not running (e.g. already stopped) are ignored.
+//
+// With standalone Redis, the queries are removed in a single transaction. With
+// Redis Cluster, their keys are removed with one command per cluster slot, so
+// some queries may be stopped while others fail, in which case the returned
+// error is a *multierror.Error with a *SpecError for each query that failed.
+func (r *redisLiveQuery) StopQueries(ctx context.Context, names []string) (err error) {
+	if o := r.observer; o != nil {
+		defer observe(o.ObserveStopQuery, time.Now(), &err)
+	}
+
+	if len(names) == 0 {
+		return nil
+	}
+	if r.readOnly.Load() {
+		return ErrReadOnly
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unique := make([]string, 0, len(names))
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			unique = append(unique, name)
+		}
+	}
+	names = unique
+
+	unlock := r.nameLocks.lockAll(names)
+	defer unlock()
+
+	defer func() {
+		for _, name := range names {
+			r.invalidateCache(name, true)
+		}
+	}()
+
+	chunkKeys, err := r.queryChunkKeys(ctx, names...)
+	if err != nil {
+		return fmt.Errorf("stop queries: read query chunks: %w", err)
+	}
+	queryKeys := make(map[string][]string, len(names))
+	for _, name := range names {
+		queryKeys[name] = append(allQueryKeys(name), chunkKeys[name]...)
+	}
+
+	if r.pool.Mode() == fleet.RedisStandalone {
+		// remove the keys and the names from the active set in a single
+		// transaction.
+		conn := r.pool.Get()
+		defer conn.Close()
+
+		if err := conn.Send("MULTI"); err != nil {
+			return fmt.Errorf("stop queries: %w", redisError(err))
+		}
+		for _, name := range names {
+			if err := conn.Send("DEL", redigo.Args{}.AddFlat(queryKeys[name])...); err != nil {
+				return fmt.Errorf("stop queries: del query keys: %w", redisError(err))
+			}
+		}
+		if err := conn.Send("SREM", redigo.Args{}.Add(activeQueriesKey).AddFlat(names)...); err != nil {
+			return fmt.Errorf("stop queries: remove query names: %w", redisError(err))
+		}
+		if err := execTransaction(ctx, conn); err != nil {
+			return fmt.Errorf("stop queries: %w", err)
+		}
+		return nil
+	}
+
+	stopped, errs := r.removeQueriesBySlot(ctx, names, queryKeys)
+	if len(stopped) > 0 {
+		if err := r.removeQueryNames(stopped...); err != nil {
+			for _, name := range stopped {
+				errs = multierror.Append(errs, &SpecError{Name: name, Err: fmt.Errorf("remove query name: %w", err)})
+			}
+		}
+	}
+	return errs.ErrorOrNil()
+}
+
+// removeQueriesBySlot removes the keys of the queries with one command per
+// cluster slot. It returns the names of the queries that were removed and the
+// errors of the others.
+func (r *redisLiveQuery) removeQueriesBySlot(ctx context.Context, names []string, queryKeys map[string][]string) ([]string, *multierror.Error) {
+	var errs *multierror.Error
+
+	namesByKey := make(map[string]string, len(names))
+	targetKeys := make([]string, 0, len(names))
+	for _, name := range names {
+		targetKey, _ := generateKeys(name)
+		namesByKey[targetKey] = name
+		targetKeys = append(targetKeys, targetKey)
+	}
+
+	var removed []string
+	for _, keys := range redis.SplitKeysBySlot(r.pool, targetKeys...) {
+		batch := make([]string, 0, len(keys))
+		var keysToDel []string
+		for _, key := range keys {
+			name := namesByKey[key]
+			batch = append(batch, name)
+			keysToDel = append(keysToDel, queryKeys[name]...)
+		}
+		if err := r.removeBatchQueryKeys(ctx, keysToDel); err != nil {
+			for _, name := range batch {
+				errs = multierror.Append(errs, &SpecError{Name: name, Err: fmt.Errorf("remove query info: %w", err)})
+			}
+			continue
+		}
+		removed = append(removed, batch...)
+	}
+	return removed, errs
+}
+
+func (r *redisLiveQuery) removeBatchQueryKeys(ctx context.Context, keys []string) error {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	if _, err := doContext(ctx, conn, "DEL", redigo.Args{}.AddFlat(keys)...); err != nil {
+		return fmt.Errorf("del query keys: %w", redisError(err))
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package live_query
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/fleetdm/fleet/v4/server/datastore/redis"
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+// field of the metadata hash that lists the indexes of the chunks of the
+// targets bitfield of a query, when it is stored in chunks.
+const metaChunks = "chunks"
+
+// WithBitfieldChunkSize splits the targets bitfield of the queries in chunks
+// of bits bits (rounded up to a multiple of 8), each stored in its own key,
+// and only the chunks that target at least one host are stored. This saves
+// memory when the targeted host IDs are sparse and high (e.g. after lots of
+// host churn), at the cost of some extra Redis commands to stop, re-run and
+// cleanup a query. A value <= 0 (the default) stores the targets in a single
+// bitfield.
+//
+// All Fleet instances sharing the same Redis must use the same chunk size, and
+// the queries that were started with a different chunk size must be stopped
+// (or be left to expire) after it is changed.
+func WithBitfieldChunkSize(bits int) Option {
+	return func(r *redisLiveQuery) {
+		if bits <= 0 {
+			r.chunkSize = 0
+			return
+		}
+		r.chunkSize = uint((bits + bitsInByte - 1) / bitsInByte * bitsInByte)
+	}
+}
+
+// generate the key of the chunk at index idx of the targets bitfield of a
+// query, it uses the same key tag as the other keys of the query. Note that
+// it does not match the pattern of the target keys used by
+// RepairActiveQueries.
+func generateChunkKey(name string, idx uint) string {
+	targetKey, _ := generateKeys(name)
+	return targetKey + ":" + strconv.FormatUint(uint64(idx), 10)
+}
+
+// hostBitKey returns the key and bit offset of the bit of hostID in the
+// targets bitfield of the query.
+func (r *redisLiveQuery) hostBitKey(name string, hostID uint) (key string, offset uint) {
+	if r.chunkSize == 0 {
+		targetKey, _ := generateKeys(name)
+		return targetKey, hostID
+	}
+	return generateChunkKey(name, hostID/r.chunkSize), hostID % r.chunkSize
+}
+
+// targetChunk is a chunk of the targets bitfield of a query.
+type targetChunk struct {
+	idx  uint
+	bits []byte
+}
+
+// mapBitfieldChunks is like mapBitfield, but it splits the bitfield in chunks
+// of chunkSize bits and only returns the chunks that have at least one bit
+// set, in ascending order of index. It is expected that the input IDs are in
+// ascending order.
+func mapBitfieldChunks(hostIDs []uint, chunkSize uint) []targetChunk {
+	var chunks []targetChunk
+	for _, id := range hostIDs {
+		idx, offset := id/chunkSize, id%chunkSize
+		if len(chunks) == 0 || chunks[len(chunks)-1].idx != idx {
+			chunks = append(chunks, targetChunk{idx: idx, bits: make([]byte, chunkSize/bitsInByte)})
+		}
+		chunks[len(chunks)-1].bits[offset/bitsInByte] |= 1 << (bitsInByte - 1 - offset%bitsInByte)
+	}
+	// trailing zero bytes are not stored, like for mapBitfield
+	for i := range chunks {
+		bits := chunks[i].bits
+		for len(bits) > 0 && bits[len(bits)-1] == 0 {
+			bits = bits[:len(bits)-1]
+		}
+		chunks[i].bits = bits
+	}
+	return chunks
+}
+
+// formatChunkIndexes returns the value of the metaChunks field for chunks.
+func formatChunkIndexes(chunks []targetChunk) string {
+	idxs := make([]string, 0, len(chunks))
+	for _, c := range chunks {
+		idxs = append(idxs, strconv.FormatUint(uint64(c.idx), 10))
+	}
+	return strings.Join(idxs, ",")
+}
+
+// parseChunkIndexes parses the metaChunks field value of a query.
+func parseChunkIndexes(value string) ([]uint, error) {
+	if value == "" {
+		return nil, nil
+	}
+	parts := strings.Split(value, ",")
+	idxs := make([]uint, 0, len(parts))
+	for _, part := range parts {
+		idx, err := strconv.ParseUint(part, 10, 0)
+		if err != nil {
+			return nil, fmt.Errorf("parse chunk index: %w", err)
+		}
+		idxs = append(idxs, uint(idx))
+	}
+	return idxs, nil
+}
+
+// parseChunkKeys returns the keys of the chunks listed in the metaChunks
+// field value of the query.
+func parseChunkKeys(name, value string) ([]string, error) {
+	idxs, err := parseChunkIndexes(value)
+	if err != nil || len(idxs) == 0 {
+		return nil, err
+	}
+	keys := make([]string, 0, len(idxs))
+	for _, idx := range idxs {
+		keys = append(keys, generateChunkKey(name, idx))
+	}
+	return keys, nil
+}
+
+// queryChunkKeys returns the keys of the chunks of the targets bitfield of the
+// queries, along with the keys of the completed hosts bitfields of those
+// chunks (see generateCompletedKey), by query name. It returns nil if the
+// targets are not stored in chunks. It is meant to collect the keys to
+// delete.
+func (r *redisLiveQuery) queryChunkKeys(ctx context.Context, names ...string) (map[string][]string, error) {
+	if r.chunkSize == 0 || len(names) == 0 {
+		return nil, nil
+	}
+
+	metaKeys := make([]string, 0, len(names))
+	for _, name := range names {
+		metaKeys = append(metaKeys, generateMetaKey(name))
+	}
+
+	chunkKeys := make(map[string][]string, len(names))
+	for _, keys := range redis.SplitKeysBySlot(r.pool, metaKeys...) {
+		if err := r.collectBatchChunkKeys(ctx, keys, chunkKeys); err != nil {
+			return nil, err
+		}
+	}
+	return chunkKeys, nil
+}
+
+func (r *redisLiveQuery) collectBatchChunkKeys(ctx context.Context, metaKeys []string, chunkKeys map[string][]string) error {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	for _, key := range metaKeys {
+		if err := conn.Send("HGET", key, metaChunks); err != nil {
+			return fmt.Errorf("get query chunks: %w", redisError(err))
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("flush pipeline: %w", redisError(err))
+	}
+
+	for _, key := range metaKeys {
+		value, err := redigo.String(receiveContext(ctx, conn))
+		if err != nil && err != redigo.ErrNil {
+			return fmt.Errorf("receive query chunks: %w", redisError(err))
+		}
+		name := extractMetaKeyName(key)
+		keys, err := parseChunkKeys(name, value)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			chunkKeys[name] = append(chunkKeys[name], key, generateCompletedKey(key))
+		}
+	}
+	return nil
+}
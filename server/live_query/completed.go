@@ -0,0 +1,250 @@
+package live_query
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fleetdm/fleet/v4/server/contexts/ctxerr"
+	"github.com/fleetdm/fleet/v4/server/datastore/redis"
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+const completedPrefix = "completed:"
+
+// WithResettableCompletions enables the recording of the hosts that completed
+// the queries stored in a bitfield, so that ResetHostQueries can return those
+// queries to them again. It is not needed for the queries started with
+// RunQueryLazy or RunQueryForLabels, whose completions are always recorded.
+// It makes each completion costlier and can double the memory used by the
+// targets of the queries (see the package documentation), and it must be set
+// on all the Fleet instances, as the completions made by an instance without
+// it cannot be reset.
+func WithResettableCompletions(enabled bool) Option {
+	return func(r *redisLiveQuery) {
+		r.resettableCompletions = enabled
+	}
+}
+
+// generate the key of the bitfield of the hosts that completed a query stored
+// in a bitfield, from the key of the targets bitfield (or of one of its
+// chunks, see hostBitKey). It uses the same key tag as the other keys of the
+// query.
+func generateCompletedKey(bitKey string) string {
+	return completedPrefix + bitKey
+}
+
+// completeBitScript records that a host completed a query stored in a
+// bitfield: its bit is moved from the targets bitfield (KEYS[1]) to the
+// completed hosts bitfield (KEYS[2]), which gets the expiration of the targets,
+// and the completed hosts counter of the metadata (KEYS[3]) is incremented if
+// it exists. Nothing is done if the host is not targeted, so that a bitfield
+// is not created again without expiration if the query was stopped. It returns
+// 1 if the host was targeted.
+var completeBitScript = redigo.NewScript(3, `
+if redis.call('GETBIT', KEYS[1], ARGV[1]) == 0 then
+  return 0
+end
+redis.call('SETBIT', KEYS[1], ARGV[1], 0)
+redis.call('SETBIT', KEYS[2], ARGV[1], 1)
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl > 0 then
+  redis.call('PEXPIRE', KEYS[2], ttl)
+end
+if redis.call('EXISTS', KEYS[3]) == 1 then
+  redis.call('HINCRBY', KEYS[3], ARGV[2], 1)
+end
+return 1
+`)
+
+// bitfieldQueryCompleted records that the host completed the query stored in
+// a bitfield. It returns true if the host was targeted, i.e. if the completion
+// was recorded.
+func (r *redisLiveQuery) bitfieldQueryCompleted(ctx context.Context, name string, hostID uint) (bool, error) {
+	bitKey, offset := r.hostBitKey(name, hostID)
+
+	conn := r.pool.Get()
+	defer conn.Close()
+	if err := redis.BindConn(r.pool, conn, bitKey); err != nil {
+		return false, fmt.Errorf("bind redis connection: %w", err)
+	}
+	// must come after BindConn due to redisc restrictions
+	conn = redis.ConfigureDoer(r.pool, conn)
+
+	targeted, err := redigo.Bool(scriptDoContext(ctx, completeBitScript, conn, bitKey, generateCompletedKey(bitKey), generateMetaKey(name), offset, metaCompleted))
+	if err != nil {
+		return false, fmt.Errorf("setbit query key: %w", redisError(err))
+	}
+	return targeted, nil
+}
+
+// resetBitScript is the reverse of completeBitScript: the bit of the host is
+// moved back from the completed hosts bitfield to the targets bitfield, if the
+// targets still exist, and the completed hosts counter is decremented. It
+// returns 1 if the host had completed the query.
+var resetBitScript = redigo.NewScript(3, `
+if redis.call('GETBIT', KEYS[2], ARGV[1]) == 0 or redis.call('EXISTS', KEYS[1]) == 0 then
+  return 0
+end
+redis.call('SETBIT', KEYS[2], ARGV[1], 0)
+redis.call('SETBIT', KEYS[1], ARGV[1], 1)
+if redis.call('EXISTS', KEYS[3]) == 1 then
+  redis.call('HINCRBY', KEYS[3], ARGV[2], -1)
+end
+return 1
+`)
+
+// resetSetScript removes the host from the set of the hosts that completed a
+// lazy query or a query that targets labels (KEYS[1]), and decrements the
+// completed hosts counter of the metadata (KEYS[2]) if it exists. It returns 1
+// if the host had completed the query.
+var resetSetScript = redigo.NewScript(2, `
+if redis.call('SREM', KEYS[1], ARGV[1]) == 0 then
+  return 0
+end
+if redis.call('EXISTS', KEYS[2]) == 1 then
+  redis.call('HINCRBY', KEYS[2], ARGV[2], -1)
+end
+return 1
+`)
+
+// ResetHostQueries clears the completion of the active queries by the host, so
+// that the queries that it completed are returned again by QueriesForHost,
+// e.g. after the host re-enrolled. The queries are only returned again if the
+// host is still targeted, and the other hosts are unaffected. The resets are
+// sent with one pipeline per cluster slot.
+//
+// The completions of the queries stored in a bitfield are only recorded if
+// the store is configured to do so (see WithResettableCompletions), and those
+// of the queries started by an older version of Fleet are never recorded. If
+// some of the active queries are stored in a bitfield and the store does not
+// record their completions, the other queries are reset and an error wrapping
+// ErrResetUnsupported is returned.
+func (r *redisLiveQuery) ResetHostQueries(ctx context.Context, hostID uint) error {
+	if r.readOnly.Load() {
+		return ErrReadOnly
+	}
+	// 0 is not a valid host ID, it is always a member of the completed hosts
+	// sets (see sendLazyTargets).
+	if hostID == 0 {
+		return nil
+	}
+
+	names, err := r.readActiveQueryNames()
+	if err != nil {
+		return ctxerr.Wrap(ctx, err, "read active queries")
+	}
+
+	namesByKey := make(map[string]string, len(names))
+	metaKeys := make([]string, 0, len(names))
+	for _, name := range names {
+		metaKey := generateMetaKey(name)
+		namesByKey[metaKey] = name
+		metaKeys = append(metaKeys, metaKey)
+	}
+
+	var unsupported int
+	for _, keys := range redis.SplitKeysBySlot(r.pool, metaKeys...) {
+		batch := make([]string, 0, len(keys))
+		for _, key := range keys {
+			batch = append(batch, namesByKey[key])
+		}
+		n, err := r.resetBatchHostQueries(ctx, batch, hostID)
+		if err != nil {
+			return ctxerr.Wrap(ctx, err, "reset host queries")
+		}
+		unsupported += n
+	}
+	if unsupported > 0 {
+		return ctxerr.Wrapf(ctx, ErrResetUnsupported, "%d queries stored in a bitfield", unsupported)
+	}
+	return nil
+}
+
+// resetBatchHostQueries resets the completion of the queries by the host, see
+// ResetHostQueries. The keys of the queries must all be in the same cluster
+// slot. It returns the number of queries that could not be reset because
+// their completions are not recorded.
+func (r *redisLiveQuery) resetBatchHostQueries(ctx context.Context, names []string, hostID uint) (int, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	metas, err := r.batchQueryMetas(ctx, conn, names)
+	if err != nil {
+		return 0, err
+	}
+
+	var sent, unsupported int
+	for _, name := range names {
+		meta := metas[name]
+		metaKey := generateMetaKey(name)
+		if meta.lazy || len(meta.labels) > 0 {
+			_, doneKey := generateLazyKeys(name)
+			if err := resetSetScript.Send(conn, doneKey, metaKey, hostID, metaCompleted); err != nil {
+				return 0, fmt.Errorf("reset completed host: %w", redisError(err))
+			}
+			sent++
+			continue
+		}
+		if !r.resettableCompletions {
+			unsupported++
+			continue
+		}
+		bitKey, offset := r.hostBitKey(name, hostID)
+		if err := resetBitScript.Send(conn, bitKey, generateCompletedKey(bitKey), metaKey, offset, metaCompleted); err != nil {
+			return 0, fmt.Errorf("reset completed host: %w", redisError(err))
+		}
+		sent++
+	}
+	if sent == 0 {
+		return unsupported, nil
+	}
+	if err := conn.Flush(); err != nil {
+		return 0, fmt.Errorf("flush pipeline: %w", redisError(err))
+	}
+	for i := 0; i < sent; i++ {
+		if _, err := receiveContext(ctx, conn); err != nil {
+			return 0, fmt.Errorf("receive reset reply: %w", redisError(err))
+		}
+	}
+	return unsupported, nil
+}
+
+// batchQueryMetas returns the metadata of the queries, the ones that are not
+// in the cache are read with a single pipeline on conn. The keys of the
+// queries must all be in the same cluster slot.
+func (r *redisLiveQuery) batchQueryMetas(ctx context.Context, conn redigo.Conn, names []string) (map[string]queryMeta, error) {
+	metas := make(map[string]queryMeta, len(names))
+	var unknown []string
+	for _, name := range names {
+		meta, known := r.queryMetaOf(name)
+		if !known {
+			unknown = append(unknown, name)
+			continue
+		}
+		metas[name] = meta
+	}
+	if len(unknown) == 0 {
+		return metas, nil
+	}
+
+	for _, name := range unknown {
+		if err := conn.Send("HMGET", queryMetaArgs(name)...); err != nil {
+			return nil, fmt.Errorf("get query metadata: %w", redisError(err))
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, fmt.Errorf("flush pipeline: %w", redisError(err))
+	}
+	for _, name := range unknown {
+		values, err := redigo.Strings(receiveContext(ctx, conn))
+		if err != nil {
+			return nil, fmt.Errorf("receive query metadata: %w", redisError(err))
+		}
+		meta, err := parseQueryMeta(values)
+		if err != nil {
+			return nil, err
+		}
+		metas[name] = meta
+	}
+	return metas, nil
+}
@@ -0,0 +1,93 @@
+package live_query
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Completion is the notification sent to a CompletionSink when a host
+// completes a live query.
+type Completion struct {
+	Name      string
+	HostID    uint
+	Timestamp time.Time
+}
+
+// CompletionSink is notified of the completions of live queries recorded by
+// the store (see WithCompletionSink).
+type CompletionSink interface {
+	// QueryCompleted is called for each completion, in the order they were
+	// recorded. It is called from a single goroutine.
+	QueryCompleted(c Completion)
+}
+
+// completionNotifier sends the completions to the sink without blocking the
+// store: completions are buffered and dropped if the buffer is full.
+type completionNotifier struct {
+	sink    CompletionSink
+	ch      chan Completion
+	dropped atomic.Uint64
+	// stopped is true once the sink is not notified anymore, the completions
+	// are then dropped.
+	stopped atomic.Bool
+}
+
+// WithCompletionSink registers a sink that is notified of the completions of
+// live queries recorded by QueryCompletedByHost. The sink is notified by the
+// goroutine started by Start. Up to bufferSize completions are buffered while
+// the sink processes them, the completions that do not fit in the buffer (or
+// that are recorded once the store is stopped) are dropped and counted in the
+// DroppedCompletions metric. The buffered completions are delivered when the
+// store is stopped (see Close).
+func WithCompletionSink(sink CompletionSink, bufferSize int) Option {
+	return func(r *redisLiveQuery) {
+		r.completions = &completionNotifier{sink: sink, ch: make(chan Completion, bufferSize)}
+	}
+}
+
+// run notifies the sink of the completions until ctx is done, and then of the
+// completions that are still buffered.
+func (n *completionNotifier) run(ctx context.Context) {
+	for {
+		select {
+		case c := <-n.ch:
+			n.sink.QueryCompleted(c)
+		case <-ctx.Done():
+			n.stopped.Store(true)
+			for {
+				select {
+				case c := <-n.ch:
+					n.sink.QueryCompleted(c)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// notify sends the completion to the sink, if any, without blocking.
+func (n *completionNotifier) notify(name string, hostID uint) {
+	if n == nil {
+		return
+	}
+	if n.stopped.Load() {
+		n.dropped.Add(1)
+		return
+	}
+	select {
+	case n.ch <- Completion{Name: name, HostID: hostID, Timestamp: time.Now()}:
+	default:
+		n.dropped.Add(1)
+	}
+}
+
+// droppedCount returns the number of completions that were dropped because
+// the buffer was full.
+func (n *completionNotifier) droppedCount() uint64 {
+	if n == nil {
+		return 0
+	}
+	return n.dropped.Load()
+}
@@ -0,0 +1,102 @@
+package live_query
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type blockingSink struct {
+	started chan struct{}
+	release chan struct{}
+
+	mu          sync.Mutex
+	completions []Completion
+}
+
+func (s *blockingSink) QueryCompleted(c Completion) {
+	s.started <- struct{}{}
+	<-s.release
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.completions = append(s.completions, c)
+}
+
+func (s *blockingSink) received() []Completion {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Completion(nil), s.completions...)
+}
+
+func TestCompletionSink(t *testing.T) {
+	sink := &blockingSink{started: make(chan struct{}, 10), release: make(chan struct{})}
+
+	var r redisLiveQuery
+	WithCompletionSink(sink, 2)(&r)
+	r.Start(context.Background())
+	n := r.completions
+
+	// the first completion is being processed by the sink
+	n.notify("a", 1)
+	<-sink.started
+
+	// the next two are buffered, the last one is dropped
+	n.notify("b", 2)
+	n.notify("c", 3)
+	n.notify("d", 4)
+	require.EqualValues(t, 1, n.droppedCount())
+
+	close(sink.release)
+	require.Eventually(t, func() bool {
+		return len(sink.received()) == 3
+	}, time.Second, 10*time.Millisecond)
+
+	got := sink.received()
+	for i, want := range []Completion{{Name: "a", HostID: 1}, {Name: "b", HostID: 2}, {Name: "c", HostID: 3}} {
+		require.Equal(t, want.Name, got[i].Name)
+		require.Equal(t, want.HostID, got[i].HostID)
+		require.False(t, got[i].Timestamp.IsZero())
+	}
+
+	require.NoError(t, r.Close(context.Background()))
+
+	// no sink is a no-op
+	var none *completionNotifier
+	none.notify("a", 1)
+	require.Zero(t, none.droppedCount())
+}
+
+func TestCompletionSinkClose(t *testing.T) {
+	sink := &blockingSink{started: make(chan struct{}, 10), release: make(chan struct{})}
+	close(sink.release)
+
+	var r redisLiveQuery
+	WithCompletionSink(sink, 10)(&r)
+	n := r.completions
+
+	// the completions are buffered until the store is started
+	n.notify("a", 1)
+	n.notify("b", 2)
+	require.Empty(t, sink.received())
+
+	// closing the store delivers the buffered completions
+	r.Start(context.Background())
+	require.NoError(t, r.Close(context.Background()))
+	got := sink.received()
+	require.Len(t, got, 2)
+	require.Equal(t, "a", got[0].Name)
+	require.Equal(t, "b", got[1].Name)
+
+	// the completions recorded once the store is closed are dropped
+	n.notify("c", 3)
+	require.EqualValues(t, 1, n.droppedCount())
+	require.Len(t, sink.received(), 2)
+
+	// closing a store that was not started is a no-op
+	var none redisLiveQuery
+	require.NoError(t, none.Close(context.Background()))
+}
@@ -0,0 +1,45 @@
+package live_query
+
+import (
+	"context"
+
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+// doContext is like conn.Do, but it fails if ctx is done. If conn supports
+// contexts (redigo.ConnWithContext, e.g. a standalone Redis connection), ctx
+// also bounds the command itself, otherwise (e.g. a Redis Cluster connection)
+// it is only checked before sending the command.
+func doContext(ctx context.Context, conn redigo.Conn, cmd string, args ...interface{}) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if cwc, ok := conn.(redigo.ConnWithContext); ok {
+		return cwc.DoContext(ctx, cmd, args...)
+	}
+	return conn.Do(cmd, args...)
+}
+
+// receiveContext is like conn.Receive, but it fails if ctx is done, see
+// doContext.
+func receiveContext(ctx context.Context, conn redigo.Conn) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if cwc, ok := conn.(redigo.ConnWithContext); ok {
+		return cwc.ReceiveContext(ctx)
+	}
+	return conn.Receive()
+}
+
+// scriptDoContext is like script.Do, but it fails if ctx is done, see
+// doContext.
+func scriptDoContext(ctx context.Context, script *redigo.Script, conn redigo.Conn, keysAndArgs ...interface{}) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if _, ok := conn.(redigo.ConnWithContext); ok {
+		return script.DoContext(ctx, conn, keysAndArgs...)
+	}
+	return script.Do(conn, keysAndArgs...)
+}
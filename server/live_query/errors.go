@@ -0,0 +1,79 @@
+package live_query
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+// Kinds of errors returned by the live query store when a Redis command
+// fails. The errors returned by the store can be checked against those with
+// errors.Is, e.g. to return the appropriate HTTP status.
+var (
+	// ErrQueryNotFound is returned when a key of the live query does not
+	// exist in Redis.
+	ErrQueryNotFound = errors.New("live query not found")
+	// ErrRedisUnavailable is returned when Redis cannot be reached, e.g. the
+	// connection was refused or timed out, or the pool is exhausted.
+	ErrRedisUnavailable = errors.New("redis unavailable")
+	// ErrRedisWrongType is returned when a key of the live query holds the
+	// wrong kind of value (the WRONGTYPE Redis error).
+	ErrRedisWrongType = errors.New("redis key holds the wrong kind of value")
+)
+
+// RedisError is the error returned by the live query store when a Redis
+// command fails. It wraps the original error along with its kind, which is
+// one of the ErrQueryNotFound, ErrRedisUnavailable or ErrRedisWrongType errors,
+// or nil if the error could not be classified.
+type RedisError struct {
+	Kind error
+	Err  error
+}
+
+func (e *RedisError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RedisError) Unwrap() []error {
+	if e.Kind == nil {
+		return []error{e.Err}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// redisError classifies the error returned by a Redis command and wraps it
+// in a RedisError. It returns nil if err is nil.
+func redisError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var rerr *RedisError
+	if errors.As(err, &rerr) {
+		return err
+	}
+
+	var (
+		kind     error
+		replyErr redigo.Error
+		netErr   net.Error
+	)
+	switch {
+	case errors.Is(err, redigo.ErrNil):
+		kind = ErrQueryNotFound
+	case errors.As(err, &replyErr) && (strings.HasPrefix(string(replyErr), "WRONGTYPE") ||
+		// before Redis 7, the errors of the commands called by a script are
+		// wrapped in a script error
+		strings.Contains(string(replyErr), ": WRONGTYPE ")):
+		kind = ErrRedisWrongType
+	case errors.As(err, &netErr),
+		errors.Is(err, redigo.ErrPoolExhausted),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF):
+		kind = ErrRedisUnavailable
+	}
+	return &RedisError{Kind: kind, Err: err}
+}
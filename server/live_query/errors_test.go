@@ -0,0 +1,51 @@
+package live_query
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	redigo "github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisError(t *testing.T) {
+	require.NoError(t, redisError(nil))
+
+	// a real connection error
+	_, dialErr := redigo.Dial("tcp", "127.0.0.1:1")
+	require.Error(t, dialErr)
+
+	cases := []struct {
+		desc string
+		err  error
+		want error
+	}{
+		{"nil reply", redigo.ErrNil, ErrQueryNotFound},
+		{"wrapped nil reply", fmt.Errorf("get: %w", redigo.ErrNil), ErrQueryNotFound},
+		{"wrong type", redigo.Error("WRONGTYPE Operation against a key holding the wrong kind of value"), ErrRedisWrongType},
+		{"wrong type in script", redigo.Error("ERR Error running script (call to f_0123): @user_script:2: WRONGTYPE Operation against a key holding the wrong kind of value"), ErrRedisWrongType},
+		{"connection refused", dialErr, ErrRedisUnavailable},
+		{"pool exhausted", redigo.ErrPoolExhausted, ErrRedisUnavailable},
+		{"connection closed", io.EOF, ErrRedisUnavailable},
+		{"other reply error", redigo.Error("ERR syntax error"), nil},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			err := redisError(c.err)
+			require.Equal(t, c.err.Error(), err.Error())
+			require.ErrorIs(t, err, c.err)
+
+			var rerr *RedisError
+			require.ErrorAs(t, err, &rerr)
+			require.Equal(t, c.want, rerr.Kind)
+			for _, kind := range []error{ErrQueryNotFound, ErrRedisUnavailable, ErrRedisWrongType} {
+				require.Equal(t, kind == c.want, errors.Is(err, kind), kind)
+			}
+
+			// wrapping again is a no-op
+			require.Same(t, rerr, redisError(err))
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package live_query
+
+import (
+	"sort"
+	"sync"
+)
+
+// HostQueriesCapOrder is how the queries returned to a host are selected
+// when it is targeted by more queries than the cap set by
+// WithMaxQueriesPerHost, among the queries of the same priority (see
+// RunQueryWithPriority).
+type HostQueriesCapOrder int
+
+const (
+	// HostQueriesRoundRobin rotates the queries returned on each check-in of
+	// the host, so that all queries are eventually returned. This is the
+	// default.
+	HostQueriesRoundRobin HostQueriesCapOrder = iota
+	// HostQueriesOldestFirst returns the oldest queries, so that the same
+	// queries are returned on each check-in of the host until it completes
+	// them. The queries started at the same time are ordered by name.
+	HostQueriesOldestFirst
+)
+
+// hostQueriesCap limits the number of live queries returned to a host on a
+// given check-in. By default, to avoid always returning the same queries to a
+// host that is targeted by more queries than the cap, the starting point in
+// the (sorted) list of queries rotates on each check-in of that host, so that
+// all queries are eventually returned.
+//
+// The rotation offsets are kept in memory, so each Fleet server instance
+// keeps its own and the fairness is per instance. They are forgotten when the
+// set of active queries changes (see reset), as the rotation then starts over,
+// so only the hosts that were over the cap since the last change are tracked.
+// They are split in shards so that the check-ins of different hosts rarely
+// contend on the same lock.
+type hostQueriesCap struct {
+	max   int // <= 0 means no limit
+	order HostQueriesCapOrder
+
+	shards [hostOffsetShards]hostOffsetShard
+}
+
+// number of shards of the rotation offsets of the hosts.
+const hostOffsetShards = 32
+
+// hostOffsetShard holds the rotation offsets of a subset of the hosts.
+type hostOffsetShard struct {
+	mu      sync.Mutex
+	offsets map[uint]int
+}
+
+// WithMaxQueriesPerHost sets the maximum number of live queries returned by
+// QueriesForHost on a given call, <= 0 means no limit (the default). The
+// queries that are returned when the cap is reached depend on
+// WithHostQueriesCapOrder.
+func WithMaxQueriesPerHost(max int) Option {
+	return func(r *redisLiveQuery) {
+		r.hostCap.max = max
+	}
+}
+
+// WithHostQueriesCapOrder sets how the queries returned to a host are
+// selected when it is targeted by more queries than the cap set by
+// WithMaxQueriesPerHost.
+func WithHostQueriesCapOrder(order HostQueriesCapOrder) Option {
+	return func(r *redisLiveQuery) {
+		r.hostCap.order = order
+	}
+}
+
+// apply returns the queries that are within the cap for that host, removing
+// the others from the queries map. metaOf returns the cached metadata of a
+// query, it is used to order the queries by priority and age.
+//
+// The queries with a priority higher than the lowest priority that fits in
+// the cap are always returned, and the remaining slots are filled with the
+// queries of that lowest priority, in the order set by c.order.
+func (c *hostQueriesCap) apply(hostID uint, queries map[string]string, metaOf func(name string) queryMeta) map[string]string {
+	if c.max <= 0 || len(queries) <= c.max {
+		return queries
+	}
+
+	names := make([]string, 0, len(queries))
+	metas := make(map[string]queryMeta, len(queries))
+	for name := range queries {
+		names = append(names, name)
+		metas[name] = metaOf(name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		mi, mj := metas[names[i]], metas[names[j]]
+		if mi.priority != mj.priority {
+			return mi.priority > mj.priority
+		}
+		// the queries with an unknown creation time are considered the oldest
+		if c.order == HostQueriesOldestFirst && !mi.createdAt.Equal(mj.createdAt) {
+			return mi.createdAt.Before(mj.createdAt)
+		}
+		return names[i] < names[j]
+	})
+
+	// split the queries that are always returned from the ones of the lowest
+	// priority that fits in the cap, which share the remaining slots.
+	lowest := metas[names[c.max-1]].priority
+	var fixed int
+	for metas[names[fixed]].priority > lowest {
+		fixed++
+	}
+	shared := names[fixed:]
+	for i, name := range shared {
+		if metas[name].priority != lowest {
+			shared = shared[:i]
+			break
+		}
+	}
+	slots := c.max - fixed
+
+	capped := make(map[string]string, c.max)
+	for _, name := range names[:fixed] {
+		capped[name] = queries[name]
+	}
+	if c.order == HostQueriesOldestFirst {
+		for _, name := range shared[:slots] {
+			capped[name] = queries[name]
+		}
+		return capped
+	}
+
+	shard := &c.shards[hostID%hostOffsetShards]
+	shard.mu.Lock()
+	if shard.offsets == nil {
+		shard.offsets = make(map[uint]int)
+	}
+	start := shard.offsets[hostID] % len(shared)
+	shard.offsets[hostID] = start + slots
+	shard.mu.Unlock()
+
+	for i := 0; i < slots; i++ {
+		name := shared[(start+i)%len(shared)]
+		capped[name] = queries[name]
+	}
+	return capped
+}
+
+// reset forgets the rotation offsets of all the hosts. It is called when the
+// set of active queries changes.
+func (c *hostQueriesCap) reset() {
+	for i := range c.shards {
+		shard := &c.shards[i]
+		shard.mu.Lock()
+		shard.offsets = nil
+		shard.mu.Unlock()
+	}
+}
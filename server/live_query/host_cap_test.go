@@ -0,0 +1,136 @@
+package live_query
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func noMeta(string) queryMeta { return queryMeta{} }
+
+func TestHostQueriesCap(t *testing.T) {
+	queries := make(map[string]string, 20)
+	for i := 0; i < 20; i++ {
+		queries[fmt.Sprintf("q%02d", i)] = fmt.Sprintf("SELECT %d", i)
+	}
+	copyQueries := func() map[string]string {
+		m := make(map[string]string, len(queries))
+		for k, v := range queries {
+			m[k] = v
+		}
+		return m
+	}
+
+	// no limit
+	var c hostQueriesCap
+	require.Equal(t, queries, c.apply(1, copyQueries(), noMeta))
+
+	c = hostQueriesCap{max: 5}
+	dispatched := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		got := c.apply(1, copyQueries(), noMeta)
+		require.Len(t, got, 5)
+		for name, sql := range got {
+			require.Equal(t, queries[name], sql)
+			dispatched[name]++
+		}
+	}
+	// all queries were dispatched exactly once in 4 check-ins
+	require.Len(t, dispatched, 20)
+	for name, n := range dispatched {
+		require.Equal(t, 1, n, name)
+	}
+
+	// another host has its own rotation
+	got := c.apply(2, copyQueries(), noMeta)
+	require.Equal(t, map[string]string{"q00": "SELECT 0", "q01": "SELECT 1", "q02": "SELECT 2", "q03": "SELECT 3", "q04": "SELECT 4"}, got)
+
+	// once under the cap, all queries are returned
+	got = c.apply(2, map[string]string{"a": "SELECT a"}, noMeta)
+	require.Equal(t, map[string]string{"a": "SELECT a"}, got)
+	require.Equal(t, 2, trackedHosts(&c))
+
+	// the offsets are forgotten on reset, the rotation starts over
+	c.reset()
+	require.Zero(t, trackedHosts(&c))
+	got = c.apply(1, copyQueries(), noMeta)
+	require.Equal(t, map[string]string{"q00": "SELECT 0", "q01": "SELECT 1", "q02": "SELECT 2", "q03": "SELECT 3", "q04": "SELECT 4"}, got)
+}
+
+// trackedHosts returns the number of hosts with a rotation offset.
+func trackedHosts(c *hostQueriesCap) int {
+	var n int
+	for i := range c.shards {
+		n += len(c.shards[i].offsets)
+	}
+	return n
+}
+
+func TestHostQueriesCapOldestFirst(t *testing.T) {
+	now := time.Now()
+	created := map[string]time.Time{
+		"a": now.Add(3 * time.Second),
+		"b": now.Add(time.Second),
+		"c": now,
+		"d": now.Add(time.Second),
+		"e": now.Add(2 * time.Second),
+	}
+	metaOf := func(name string) queryMeta { return queryMeta{createdAt: created[name]} }
+	queries := func() map[string]string {
+		return map[string]string{"a": "SELECT a", "b": "SELECT b", "c": "SELECT c", "d": "SELECT d", "e": "SELECT e", "f": "SELECT f"}
+	}
+
+	c := hostQueriesCap{max: 3, order: HostQueriesOldestFirst}
+	for i := 0; i < 3; i++ {
+		// f has no creation time so it is the oldest, b and d are ordered by name
+		require.Equal(t, map[string]string{"f": "SELECT f", "c": "SELECT c", "b": "SELECT b"}, c.apply(1, queries(), metaOf))
+	}
+	require.Zero(t, trackedHosts(&c))
+
+	c.max = 6
+	require.Equal(t, queries(), c.apply(1, queries(), metaOf))
+}
+
+func TestHostQueriesCapPriority(t *testing.T) {
+	now := time.Now()
+	metas := map[string]queryMeta{
+		"a": {createdAt: now},
+		"b": {createdAt: now.Add(time.Second)},
+		"c": {createdAt: now.Add(2 * time.Second)},
+		"d": {createdAt: now.Add(3 * time.Second)},
+		"e": {createdAt: now.Add(4 * time.Second), priority: 10},
+		"f": {createdAt: now.Add(5 * time.Second), priority: 5},
+	}
+	metaOf := func(name string) queryMeta { return metas[name] }
+	queries := func() map[string]string {
+		return map[string]string{"a": "SELECT a", "b": "SELECT b", "c": "SELECT c", "d": "SELECT d", "e": "SELECT e", "f": "SELECT f"}
+	}
+
+	// the newest queries are returned first because of their priority
+	c := hostQueriesCap{max: 3, order: HostQueriesOldestFirst}
+	require.Equal(t, map[string]string{"e": "SELECT e", "f": "SELECT f", "a": "SELECT a"}, c.apply(1, queries(), metaOf))
+	c.max = 1
+	require.Equal(t, map[string]string{"e": "SELECT e"}, c.apply(1, queries(), metaOf))
+
+	// the priority queries are returned on each check-in, the remaining slot
+	// rotates over the other queries
+	c = hostQueriesCap{max: 3}
+	dispatched := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		got := c.apply(1, queries(), metaOf)
+		require.Len(t, got, 3)
+		require.Contains(t, got, "e")
+		require.Contains(t, got, "f")
+		for name := range got {
+			dispatched[name]++
+		}
+	}
+	require.Equal(t, map[string]int{"a": 1, "b": 1, "c": 1, "d": 1, "e": 4, "f": 4}, dispatched)
+
+	// without priorities, the high priority query would be dropped
+	metas["e"] = queryMeta{createdAt: metas["e"].createdAt}
+	c = hostQueriesCap{max: 2, order: HostQueriesOldestFirst}
+	require.NotContains(t, c.apply(1, queries(), metaOf), "e")
+}
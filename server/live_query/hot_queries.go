@@ -0,0 +1,134 @@
+package live_query
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/log/level"
+)
+
+// hotQueriesCounter counts how many times each live query was dispatched to a
+// host since the last report. Counts are reset after each report, so they
+// reflect the activity during the last reporting interval.
+//
+// The counters are incremented without locking as they are updated on each
+// check-in, so the counts are approximate: a dispatch that races with a report
+// may be counted in the next interval, or not at all if the query was not
+// dispatched during the previous interval.
+type hotQueriesCounter struct {
+	// reporting configuration, disabled if interval <= 0.
+	interval time.Duration
+	topN     int
+
+	// counts holds the *atomic.Uint64 dispatch count of each query.
+	counts sync.Map
+}
+
+// hotQuery is a live query along with its number of dispatches.
+type hotQuery struct {
+	Name       string
+	Dispatches uint64
+}
+
+// WithHotQueriesReport enables periodic logging of the topN most dispatched
+// live queries, every interval. The report is logged by the goroutine started
+// by Start.
+func WithHotQueriesReport(interval time.Duration, topN int) Option {
+	return func(r *redisLiveQuery) {
+		r.hotQueries.interval = interval
+		r.hotQueries.topN = topN
+	}
+}
+
+func (hq *hotQueriesCounter) enabled() bool {
+	return hq.interval > 0 && hq.topN > 0
+}
+
+// recordDispatches increments the dispatch count of the queries that are
+// returned to a host.
+func (r *redisLiveQuery) recordDispatches(queries map[string]string) {
+	hq := &r.hotQueries
+	if !hq.enabled() {
+		return
+	}
+
+	for name := range queries {
+		c, ok := hq.counts.Load(name)
+		if !ok {
+			c, _ = hq.counts.LoadOrStore(name, new(atomic.Uint64))
+		}
+		c.(*atomic.Uint64).Add(1)
+	}
+}
+
+// snapshot returns the dispatch counts of the queries. If reset is true, the
+// counts are reset and the queries that were not dispatched since the last
+// reset are forgotten.
+func (hq *hotQueriesCounter) snapshot(reset bool) map[string]uint64 {
+	counts := make(map[string]uint64)
+	hq.counts.Range(func(key, value interface{}) bool {
+		c := value.(*atomic.Uint64)
+		var n uint64
+		if reset {
+			n = c.Swap(0)
+		} else {
+			n = c.Load()
+		}
+		if n == 0 {
+			if reset {
+				hq.counts.Delete(key)
+			}
+			return true
+		}
+		counts[key.(string)] = n
+		return true
+	})
+	return counts
+}
+
+// runHotQueriesReport logs the hot queries report every interval until ctx
+// is done.
+func (r *redisLiveQuery) runHotQueriesReport(ctx context.Context) {
+	ticker := time.NewTicker(r.hotQueries.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.reportHotQueries()
+		}
+	}
+}
+
+// reportHotQueries logs the most dispatched queries since the last report and
+// resets the counts.
+func (r *redisLiveQuery) reportHotQueries() {
+	report := topHotQueries(r.hotQueries.snapshot(true), r.hotQueries.topN)
+	for i, q := range report {
+		level.Info(r.logger).Log("msg", "hot live query", "rank", i+1, "name", q.Name, "dispatches", q.Dispatches, "interval", r.hotQueries.interval)
+	}
+}
+
+// topHotQueries returns the n most dispatched queries, in descending order of
+// dispatches.
+func topHotQueries(counts map[string]uint64, n int) []hotQuery {
+	queries := make([]hotQuery, 0, len(counts))
+	for name, count := range counts {
+		queries = append(queries, hotQuery{Name: name, Dispatches: count})
+	}
+	sort.Slice(queries, func(i, j int) bool {
+		if queries[i].Dispatches == queries[j].Dispatches {
+			return queries[i].Name < queries[j].Name
+		}
+		return queries[i].Dispatches > queries[j].Dispatches
+	})
+	if len(queries) > n {
+		queries = queries[:n]
+	}
+	return queries
+}
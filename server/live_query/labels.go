@@ -0,0 +1,245 @@
+package live_query
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fleetdm/fleet/v4/server/contexts/ctxerr"
+	"github.com/fleetdm/fleet/v4/server/datastore/redis"
+	"github.com/fleetdm/fleet/v4/server/fleet"
+	"github.com/fleetdm/fleet/v4/server/ptr"
+	"github.com/go-kit/log/level"
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+// field of the metadata hash that lists the IDs of the labels targeted by a
+// query started with RunQueryForLabels.
+const metaLabels = "labels"
+
+// LabelMembershipResolver returns the IDs of the labels the host is currently
+// a member of, in any order. It is called by QueriesForHost at most once per
+// call, and only if at least one active query targets labels, so it is on the
+// host check-in path and must be fast and safe for concurrent use. It receives
+// the context of the call (QueriesForHosts calls it once per host with its
+// context, QueriesForHost with a background context). If it returns an error,
+// the error is logged and the queries that target labels are not returned to
+// the host for that call (the other queries still are).
+type LabelMembershipResolver func(ctx context.Context, hostID uint) ([]uint, error)
+
+// LabelHostsCounter returns the number of hosts that are members of any of the
+// labels. It is called by RunQueryForLabels to record the number of hosts
+// targeted by the query.
+type LabelHostsCounter func(ctx context.Context, labelIDs []uint) (int, error)
+
+// WithLabelMembershipResolver sets the resolver used to determine the hosts
+// targeted by the queries started with RunQueryForLabels.
+func WithLabelMembershipResolver(resolve LabelMembershipResolver) Option {
+	return func(r *redisLiveQuery) {
+		r.labelResolver = resolve
+	}
+}
+
+// WithLabelHostsCounter sets the function used to count the hosts targeted by
+// the queries started with RunQueryForLabels.
+func WithLabelHostsCounter(count LabelHostsCounter) Option {
+	return func(r *redisLiveQuery) {
+		r.labelHostsCounter = count
+	}
+}
+
+// WithDatastoreLabels resolves the labels of the hosts and counts the members
+// of the labels with the datastore, see WithLabelMembershipResolver and
+// WithLabelHostsCounter.
+func WithDatastoreLabels(ds fleet.Datastore) Option {
+	return func(r *redisLiveQuery) {
+		r.labelResolver = func(ctx context.Context, hostID uint) ([]uint, error) {
+			labels, err := ds.ListLabelsForHost(ctx, hostID)
+			if err != nil {
+				return nil, err
+			}
+			ids := make([]uint, 0, len(labels))
+			for _, label := range labels {
+				ids = append(ids, label.ID)
+			}
+			return ids, nil
+		}
+		r.labelHostsCounter = func(ctx context.Context, labelIDs []uint) (int, error) {
+			filter := fleet.TeamFilter{User: &fleet.User{GlobalRole: ptr.String(fleet.RoleAdmin)}}
+			metrics, err := ds.CountHostsInTargets(ctx, filter, fleet.HostTargets{LabelIDs: labelIDs}, time.Now())
+			if err != nil {
+				return 0, err
+			}
+			return int(metrics.TotalHosts), nil
+		}
+	}
+}
+
+// RunQueryForLabels is like RunQueryContext, but the query targets the hosts
+// that are members of any of the labels instead of a list of hosts. The
+// membership is resolved when QueriesForHost is called (see
+// LabelMembershipResolver), so a host that joins one of the labels after the
+// query was started receives it, and a host that leaves all of them stops
+// receiving it. The hosts that completed the query are stored in a set, as for
+// RunQueryLazy. The query is reported by the statistics with the number of
+// members of the labels when it was started (see LabelHostsCounter), or with 0
+// targeted hosts if there is no counter.
+func (r *redisLiveQuery) RunQueryForLabels(ctx context.Context, name, sql string, labelIDs []uint) error {
+	if r.labelResolver == nil {
+		return errors.New("no label membership resolver configured")
+	}
+	if len(labelIDs) == 0 {
+		return errors.New("no labels targeted")
+	}
+
+	info := queryInfo{name: name, sql: sql, labels: labelIDs}
+	if r.labelHostsCounter != nil {
+		n, err := r.labelHostsCounter(ctx, labelIDs)
+		if err != nil {
+			return ctxerr.Wrap(ctx, err, "count label hosts")
+		}
+		info.labelHosts = n
+	}
+	return r.runQuery(ctx, info)
+}
+
+// formatLabelIDs returns the value of the metaLabels field for labelIDs.
+func formatLabelIDs(labelIDs []uint) string {
+	ids := make([]string, 0, len(labelIDs))
+	for _, id := range labelIDs {
+		ids = append(ids, strconv.FormatUint(uint64(id), 10))
+	}
+	return strings.Join(ids, ",")
+}
+
+// parseLabelIDs parses the value of the metaLabels field of a query.
+func parseLabelIDs(value string) ([]uint, error) {
+	if value == "" {
+		return nil, nil
+	}
+	parts := strings.Split(value, ",")
+	ids := make([]uint, 0, len(parts))
+	for _, part := range parts {
+		id, err := strconv.ParseUint(part, 10, 0)
+		if err != nil {
+			return nil, fmt.Errorf("parse label ID: %w", err)
+		}
+		ids = append(ids, uint(id))
+	}
+	return ids, nil
+}
+
+// labelsMatch returns true if any of labelIDs is in hostLabels.
+func labelsMatch(labelIDs []uint, hostLabels map[uint]bool) bool {
+	for _, id := range labelIDs {
+		if hostLabels[id] {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveHostLabels returns the labels of the host if any of the named
+// queries targets labels, nil otherwise. The modes of the queries must be
+// cached.
+func (r *redisLiveQuery) resolveHostLabels(ctx context.Context, hostID uint, names []string) map[uint]bool {
+	if r.labelResolver == nil {
+		return nil
+	}
+	var needed bool
+	for _, name := range names {
+		if mode, _ := r.queryMetaOf(name); len(mode.labels) > 0 {
+			needed = true
+			break
+		}
+	}
+	if !needed {
+		return nil
+	}
+
+	labelIDs, err := r.labelResolver(ctx, hostID)
+	if err != nil {
+		level.Warn(r.logger).Log("msg", "resolve host labels for live queries", "host_id", hostID, "err", err)
+		return nil
+	}
+	hostLabels := make(map[uint]bool, len(labelIDs))
+	for _, id := range labelIDs {
+		hostLabels[id] = true
+	}
+	return hostLabels
+}
+
+// sendLabelTargets sends (without flushing) the commands to store the targets
+// of a query that targets labels, i.e. the set of the hosts that completed it,
+// which always contains 0 like for lazy queries (see sendLazyTargets). It
+// returns the number of commands sent.
+func sendLabelTargets(conn redigo.Conn, info queryInfo, expMillis int64) (int, error) {
+	_, doneKey := generateLazyKeys(info.name)
+	if err := conn.Send("SADD", doneKey, 0); err != nil {
+		return 0, fmt.Errorf("create completed hosts: %w", redisError(err))
+	}
+	if err := conn.Send("PEXPIRE", doneKey, expMillis); err != nil {
+		return 0, fmt.Errorf("expire completed hosts: %w", redisError(err))
+	}
+	return 2, nil
+}
+
+// sendLabelMembership sends (without flushing) the command to check if the
+// host completed the query that targets labels. The reply must be received
+// with receiveLabelMembership.
+func sendLabelMembership(conn redigo.Conn, name string, hostID uint) error {
+	_, doneKey := generateLazyKeys(name)
+	if err := conn.Send("SISMEMBER", doneKey, hostID); err != nil {
+		return fmt.Errorf("check completed host: %w", redisError(err))
+	}
+	return nil
+}
+
+// receiveLabelMembership receives the reply of the command sent by
+// sendLabelMembership and returns true if the host did not complete the query
+// yet.
+func receiveLabelMembership(ctx context.Context, conn redigo.Conn) (bool, error) {
+	done, err := redigo.Bool(receiveContext(ctx, conn))
+	if err != nil {
+		return false, fmt.Errorf("receive completed host: %w", redisError(err))
+	}
+	return !done, nil
+}
+
+// addCompletedScript adds the host to the set of the hosts that completed a
+// query only if the set exists, so that it is not created again without
+// expiration if the query was stopped.
+var addCompletedScript = redigo.NewScript(1, `
+if redis.call('EXISTS', KEYS[1]) == 0 then
+  return 0
+end
+return redis.call('SADD', KEYS[1], ARGV[1])
+`)
+
+// labelQueryCompleted records that the host completed the query that targets
+// labels. The membership of the host is not checked, a host only completes
+// the queries that it received. It returns true if the completion was
+// recorded, i.e. if the query exists and the host had not completed it yet.
+func (r *redisLiveQuery) labelQueryCompleted(ctx context.Context, name string, hostID uint) (bool, error) {
+	_, doneKey := generateLazyKeys(name)
+
+	conn := r.pool.Get()
+	defer conn.Close()
+	if err := redis.BindConn(r.pool, conn, doneKey); err != nil {
+		return false, fmt.Errorf("bind redis connection: %w", err)
+	}
+	// must come after BindConn due to redisc restrictions
+	conn = redis.ConfigureDoer(r.pool, conn)
+
+	added, err := redigo.Int(scriptDoContext(ctx, addCompletedScript, conn, doneKey, hostID))
+	if err != nil {
+		return false, fmt.Errorf("add completed host: %w", redisError(err))
+	}
+	if added == 1 {
+		return true, r.incrCompletedHosts(ctx, name)
+	}
+	return false, nil
+}
@@ -0,0 +1,229 @@
+package live_query
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+const (
+	rangesPrefix = "ranges:"
+	donePrefix   = "done:"
+
+	// field of the metadata hash that is set to 1 for the lazy queries.
+	metaLazy = "lazy"
+)
+
+// RunQueryLazy is like RunQuery, but instead of a bitfield of the targeted
+// hosts, it stores the ranges of consecutive host IDs in a sorted set, and the
+// hosts that completed the query in a set. Whether a host is targeted is then
+// determined when QueriesForHost is called, with 2 Redis commands instead of
+// 1 for this query. This is cheaper to store than the bitfield when the
+// targeted host IDs are mostly consecutive and high (e.g. a large static list
+// of hosts), but costlier for lists with many gaps.
+func (r *redisLiveQuery) RunQueryLazy(name, sql string, hostIDs []uint) error {
+	return r.runQuery(context.Background(), queryInfo{name: name, sql: sql, hostIDs: hostIDs, lazy: true})
+}
+
+// generate the keys of the targeted host ranges and of the hosts that
+// completed a lazy query, they use the same key tag as the other keys of the
+// query.
+func generateLazyKeys(name string) (rangesKey, doneKey string) {
+	targetKey, _ := generateKeys(name)
+	return rangesPrefix + targetKey, donePrefix + targetKey
+}
+
+// hostRange is a range of consecutive host IDs, inclusive.
+type hostRange struct {
+	start, end uint
+}
+
+// mapHostRanges returns the ranges of consecutive host IDs of hostIDs. It is
+// expected that the input IDs are in ascending order.
+func mapHostRanges(hostIDs []uint) []hostRange {
+	var ranges []hostRange
+	for _, id := range hostIDs {
+		if n := len(ranges); n > 0 && (ranges[n-1].end == id || ranges[n-1].end+1 == id) {
+			ranges[n-1].end = id
+			continue
+		}
+		ranges = append(ranges, hostRange{start: id, end: id})
+	}
+	return ranges
+}
+
+// sendLazyTargets sends (without flushing) the commands to store the targets
+// of a lazy query. The ranges are stored with their end as score and their
+// start as member, so that the first range that ends at or after a host ID is
+// the only one that can contain it. The set of hosts that completed the query
+// always contains 0, which is not a valid host ID, so that it can be created
+// with an expiration. It returns the number of commands sent.
+func sendLazyTargets(conn redigo.Conn, info queryInfo, expMillis int64) (int, error) {
+	rangesKey, doneKey := generateLazyKeys(info.name)
+
+	args := redigo.Args{}.Add(rangesKey)
+	for _, rg := range mapHostRanges(info.hostIDs) {
+		args = args.Add(rg.end, rg.start)
+	}
+	if err := conn.Send("ZADD", args...); err != nil {
+		return 0, fmt.Errorf("set target ranges: %w", redisError(err))
+	}
+	if err := conn.Send("PEXPIRE", rangesKey, expMillis); err != nil {
+		return 0, fmt.Errorf("expire target ranges: %w", redisError(err))
+	}
+	if err := conn.Send("SADD", doneKey, 0); err != nil {
+		return 0, fmt.Errorf("create completed hosts: %w", redisError(err))
+	}
+	if err := conn.Send("PEXPIRE", doneKey, expMillis); err != nil {
+		return 0, fmt.Errorf("expire completed hosts: %w", redisError(err))
+	}
+	return 4, nil
+}
+
+// sendLazyMembership sends (without flushing) the commands to check if the
+// host is targeted by the lazy query and did not complete it yet. The replies
+// must be received with receiveLazyMembership.
+func sendLazyMembership(conn redigo.Conn, name string, hostID uint) error {
+	rangesKey, doneKey := generateLazyKeys(name)
+	if err := conn.Send("ZRANGEBYSCORE", rangesKey, hostID, "+inf", "LIMIT", 0, 1); err != nil {
+		return fmt.Errorf("get target range: %w", redisError(err))
+	}
+	if err := conn.Send("SISMEMBER", doneKey, hostID); err != nil {
+		return fmt.Errorf("check completed host: %w", redisError(err))
+	}
+	return nil
+}
+
+// receiveLazyMembership receives the replies of the commands sent by
+// sendLazyMembership and returns true if the host is targeted by the query
+// and did not complete it yet.
+func receiveLazyMembership(ctx context.Context, conn redigo.Conn, hostID uint) (bool, error) {
+	starts, err := redigo.Strings(receiveContext(ctx, conn))
+	if err != nil {
+		return false, fmt.Errorf("receive target range: %w", redisError(err))
+	}
+	done, err := redigo.Bool(receiveContext(ctx, conn))
+	if err != nil {
+		return false, fmt.Errorf("receive completed host: %w", redisError(err))
+	}
+	if len(starts) == 0 || done {
+		return false, nil
+	}
+	start, err := strconv.ParseUint(starts[0], 10, 0)
+	if err != nil {
+		return false, fmt.Errorf("parse target range: %w", err)
+	}
+	return uint(start) <= hostID, nil
+}
+
+// queryMeta is the metadata of a query that is cached for each active query:
+// how its targets are stored (the zero value is for the queries stored in a
+// bitfield) and when it was created.
+type queryMeta struct {
+	// lazy is true if the query was stored with RunQueryLazy.
+	lazy bool
+	// labels are the IDs of the targeted labels if the query was stored with
+	// RunQueryForLabels.
+	labels []uint
+	// createdAt is the time the query was started, it is zero if unknown.
+	createdAt time.Time
+	// priority is the priority of the query (see RunQueryWithPriority).
+	priority int
+}
+
+// queryMetaOf is a thread-safe method to get the metadata of the query. The
+// known return value is false if the query is not in the cache, in which case
+// it must be read from the metadata of the query.
+func (r *redisLiveQuery) queryMetaOf(name string) (meta queryMeta, known bool) {
+	r.cache.mu.RLock()
+	defer r.cache.mu.RUnlock()
+	meta, known = r.cache.queryMetas[name]
+	return meta, known
+}
+
+// cachedQueryMeta is like queryMetaOf, but it returns the zero value if the
+// query is not in the cache.
+func (r *redisLiveQuery) cachedQueryMeta(name string) queryMeta {
+	meta, _ := r.queryMetaOf(name)
+	return meta
+}
+
+// setQueryMeta is a thread-safe method to store the metadata of the query in
+// the cache.
+func (r *redisLiveQuery) setQueryMeta(name string, meta queryMeta) {
+	r.cache.mu.Lock()
+	defer r.cache.mu.Unlock()
+	r.cache.queryMetas[name] = meta
+}
+
+// queryMetaArgs returns the arguments of the HMGET command that reads the
+// metadata of the query, the reply must be parsed with parseQueryMeta.
+func queryMetaArgs(name string) redigo.Args {
+	return redigo.Args{}.Add(generateMetaKey(name), metaLazy, metaLabels, metaCreatedAt, metaPriority)
+}
+
+// readQueryMeta reads the metadata of the query from Redis.
+func readQueryMeta(ctx context.Context, conn redigo.Conn, name string) (queryMeta, error) {
+	meta, err := redigo.Strings(doContext(ctx, conn, "HMGET", queryMetaArgs(name)...))
+	if err != nil {
+		return queryMeta{}, fmt.Errorf("get query metadata: %w", redisError(err))
+	}
+	return parseQueryMeta(meta)
+}
+
+// parseQueryMeta parses the reply of the HMGET command of queryMetaArgs.
+func parseQueryMeta(meta []string) (queryMeta, error) {
+	labels, err := parseLabelIDs(meta[1])
+	if err != nil {
+		return queryMeta{}, err
+	}
+	var createdAt time.Time
+	if meta[2] != "" {
+		nanos, err := strconv.ParseInt(meta[2], 10, 64)
+		if err != nil {
+			return queryMeta{}, fmt.Errorf("parse query creation time: %w", err)
+		}
+		createdAt = time.Unix(0, nanos)
+	}
+	var priority int
+	if meta[3] != "" {
+		if priority, err = strconv.Atoi(meta[3]); err != nil {
+			return queryMeta{}, fmt.Errorf("parse query priority: %w", err)
+		}
+	}
+	return queryMeta{lazy: meta[0] == "1", labels: labels, createdAt: createdAt, priority: priority}, nil
+}
+
+// lazyQueryCompleted records that the host completed the lazy query. It is
+// only recorded if the host is targeted by the query, so that the completed
+// hosts can be counted, and so that the set is not created again without
+// expiration if the query was stopped. It returns true if the completion was
+// recorded.
+func (r *redisLiveQuery) lazyQueryCompleted(ctx context.Context, name string, hostID uint) (bool, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	if err := sendLazyMembership(conn, name, hostID); err != nil {
+		return false, err
+	}
+	if err := conn.Flush(); err != nil {
+		return false, fmt.Errorf("flush pipeline: %w", redisError(err))
+	}
+	pending, err := receiveLazyMembership(ctx, conn, hostID)
+	if err != nil || !pending {
+		return false, err
+	}
+
+	_, doneKey := generateLazyKeys(name)
+	added, err := redigo.Int(doContext(ctx, conn, "SADD", doneKey, hostID))
+	if err != nil {
+		return false, fmt.Errorf("add completed host: %w", redisError(err))
+	}
+	if added == 1 {
+		return true, r.incrCompletedHosts(ctx, name)
+	}
+	return false, nil
+}
@@ -3,6 +3,7 @@ package live_query_mock
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/fleetdm/fleet/v4/server/fleet"
 	"github.com/stretchr/testify/mock"
@@ -29,26 +30,128 @@ func (m *MockLiveQuery) RunQuery(name, sql string, hostIDs []uint) error {
 	return args.Error(0)
 }
 
+// RunQueryContext mocks the live query store RunQueryContext method.
+func (m *MockLiveQuery) RunQueryContext(ctx context.Context, name, sql string, hostIDs []uint) error {
+	args := m.Called(ctx, name, sql, hostIDs)
+	return args.Error(0)
+}
+
+// RunQueries mocks the live query store RunQueries method.
+func (m *MockLiveQuery) RunQueries(ctx context.Context, queries []fleet.LiveQuerySpec) error {
+	args := m.Called(ctx, queries)
+	return args.Error(0)
+}
+
+// RunQueryWithTTL mocks the live query store RunQueryWithTTL method.
+func (m *MockLiveQuery) RunQueryWithTTL(ctx context.Context, name, sql string, hostIDs []uint, ttl time.Duration) error {
+	args := m.Called(ctx, name, sql, hostIDs, ttl)
+	return args.Error(0)
+}
+
+// RunQueryWithPriority mocks the live query store RunQueryWithPriority method.
+func (m *MockLiveQuery) RunQueryWithPriority(ctx context.Context, name, sql string, hostIDs []uint, priority int) error {
+	args := m.Called(ctx, name, sql, hostIDs, priority)
+	return args.Error(0)
+}
+
+// ReplaceQuery mocks the live query store ReplaceQuery method.
+func (m *MockLiveQuery) ReplaceQuery(ctx context.Context, name, sql string, hostIDs []uint) error {
+	args := m.Called(ctx, name, sql, hostIDs)
+	return args.Error(0)
+}
+
 // StopQuery mocks the live query store StopQuery method.
 func (m *MockLiveQuery) StopQuery(name string) error {
 	args := m.Called(name)
 	return args.Error(0)
 }
 
+// StopQueries mocks the live query store StopQueries method.
+func (m *MockLiveQuery) StopQueries(ctx context.Context, names []string) error {
+	args := m.Called(ctx, names)
+	return args.Error(0)
+}
+
 // QueriesForHost mocks the live query store QueriesForHost method.
 func (m *MockLiveQuery) QueriesForHost(hostID uint) (map[string]string, error) {
 	args := m.Called(hostID)
 	return args.Get(0).(map[string]string), args.Error(1)
 }
 
+// QueriesForHostPlatform mocks the live query store QueriesForHostPlatform method.
+func (m *MockLiveQuery) QueriesForHostPlatform(hostID uint, hostPlatform string) (map[string]string, error) {
+	args := m.Called(hostID, hostPlatform)
+	return args.Get(0).(map[string]string), args.Error(1)
+}
+
+// QueriesForHostWithMeta mocks the live query store QueriesForHostWithMeta method.
+func (m *MockLiveQuery) QueriesForHostWithMeta(hostID uint) (map[string]fleet.LiveQueryInfo, error) {
+	args := m.Called(hostID)
+	return args.Get(0).(map[string]fleet.LiveQueryInfo), args.Error(1)
+}
+
+// QueriesForHosts mocks the live query store QueriesForHosts method.
+func (m *MockLiveQuery) QueriesForHosts(ctx context.Context, hostIDs []uint) (map[uint]map[string]string, error) {
+	args := m.Called(ctx, hostIDs)
+	return args.Get(0).(map[uint]map[string]string), args.Error(1)
+}
+
 // QueryCompletedByHost mocks the live query store QueryCompletedByHost method.
 func (m *MockLiveQuery) QueryCompletedByHost(name string, hostID uint) error {
 	args := m.Called(name, hostID)
 	return args.Error(0)
 }
 
+// QueryCompletedByHostContext mocks the live query store QueryCompletedByHostContext method.
+func (m *MockLiveQuery) QueryCompletedByHostContext(ctx context.Context, name string, hostID uint) error {
+	args := m.Called(ctx, name, hostID)
+	return args.Error(0)
+}
+
+// QueryCompletionStats mocks the live query store QueryCompletionStats method.
+func (m *MockLiveQuery) QueryCompletionStats(ctx context.Context, name string) (total, completed int, err error) {
+	args := m.Called(ctx, name)
+	return args.Int(0), args.Int(1), args.Error(2)
+}
+
+// ResetHostQueries mocks the live query store ResetHostQueries method.
+func (m *MockLiveQuery) ResetHostQueries(ctx context.Context, hostID uint) error {
+	args := m.Called(ctx, hostID)
+	return args.Error(0)
+}
+
+// PendingHostsForQuery mocks the live query store PendingHostsForQuery method.
+func (m *MockLiveQuery) PendingHostsForQuery(ctx context.Context, name string) ([]uint, error) {
+	args := m.Called(ctx, name)
+	return args.Get(0).([]uint), args.Error(1)
+}
+
 // CleanupInactiveQueries mocks the live query store CleanupInactiveQueries method.
 func (m *MockLiveQuery) CleanupInactiveQueries(ctx context.Context, inactiveCampaignIDs []uint) error {
 	args := m.Called(ctx, inactiveCampaignIDs)
 	return args.Error(0)
 }
+
+// CleanupInactiveQueriesDryRun mocks the live query store CleanupInactiveQueriesDryRun method.
+func (m *MockLiveQuery) CleanupInactiveQueriesDryRun(ctx context.Context, activeCampaignIDs []uint) ([]string, error) {
+	args := m.Called(ctx, activeCampaignIDs)
+	return args.Get(0).([]string), args.Error(1)
+}
+
+// RepairActiveQueries mocks the live query store RepairActiveQueries method.
+func (m *MockLiveQuery) RepairActiveQueries(ctx context.Context) ([]string, []string, error) {
+	args := m.Called(ctx)
+	return args.Get(0).([]string), args.Get(1).([]string), args.Error(2)
+}
+
+// ActiveQueryNames mocks the live query store ActiveQueryNames method.
+func (m *MockLiveQuery) ActiveQueryNames(ctx context.Context) ([]string, error) {
+	args := m.Called(ctx)
+	return args.Get(0).([]string), args.Error(1)
+}
+
+// QueryExists mocks the live query store QueryExists method.
+func (m *MockLiveQuery) QueryExists(ctx context.Context, name string) (bool, error) {
+	args := m.Called(ctx, name)
+	return args.Bool(0), args.Error(1)
+}
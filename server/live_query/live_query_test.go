@@ -2,12 +2,16 @@ package live_query
 
 import (
 	"context"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/fleetdm/fleet/v4/server/datastore/redis"
 	"github.com/fleetdm/fleet/v4/server/fleet"
 	redigo "github.com/gomodule/redigo/redis"
+	"github.com/hashicorp/go-multierror"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -19,6 +23,22 @@ var testFunctions = [...]func(*testing.T, fleet.LiveQueryStore){
 	testLiveQueryExpiredQuery,
 	testLiveQueryOnlyExpired,
 	testLiveQueryCleanupInactive,
+	testLiveQueryConcurrentRunStop,
+	testLiveQueryRedisErrors,
+	testLiveQueryRepairActiveQueries,
+	testLiveQueryRunQueryContext,
+	testLiveQueryRunQueries,
+	testLiveQueryRunQueryWithTTL,
+	testLiveQueryQueriesForHostWithMeta,
+	testLiveQueryCompletionStats,
+	testLiveQueryStopQueries,
+	testLiveQueryActiveQueryNames,
+	testLiveQueryQueryCompletedByHostContext,
+	testLiveQueryQueryExists,
+	testLiveQueryAlreadyRunning,
+	testLiveQueryPendingHostsForQuery,
+	testLiveQueryQueriesForHosts,
+	testLiveQueryResetHostQueries,
 }
 
 func testLiveQuery(t *testing.T, store fleet.LiveQueryStore) {
@@ -175,6 +195,17 @@ func testLiveQueryCleanupInactive(t *testing.T, store fleet.LiveQueryStore) {
 	require.NoError(t, err)
 	require.Equal(t, map[string]string{"1": "SELECT 1", "4": "SELECT 4"}, m)
 
+	// a dry run reports the queries of the inactive campaigns but keeps them
+	removed, err := store.CleanupInactiveQueriesDryRun(ctx, []uint{2, 4, 6})
+	require.NoError(t, err)
+	require.Equal(t, []string{"1", "3", "5"}, removed)
+	activeNames, err = store.LoadActiveQueryNames()
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"1", "2", "3", "4", "5"}, activeNames)
+	m, err = store.QueriesForHost(1)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"1": "SELECT 1", "4": "SELECT 4"}, m)
+
 	// simulate that only campaigns 2 and 4 are still active, cleanup the rest
 	err = store.CleanupInactiveQueries(ctx, []uint{1, 3, 5})
 	require.NoError(t, err)
@@ -221,3 +252,628 @@ func testLiveQueryCleanupInactive(t *testing.T, store fleet.LiveQueryStore) {
 	require.NoError(t, err)
 	require.Empty(t, m)
 }
+
+func testLiveQueryConcurrentRunStop(t *testing.T, store fleet.LiveQueryStore) {
+	pool := store.(*redisLiveQuery).pool
+	conn := redis.ConfigureDoer(pool, pool.Get())
+	defer conn.Close()
+
+	targetKey, sqlKey := generateKeys("test")
+
+	for i := 0; i < 10; i++ {
+		var wg sync.WaitGroup
+		for j := 0; j < 20; j++ {
+			wg.Add(1)
+			go func(run bool) {
+				defer wg.Done()
+				if run {
+					assert.NoError(t, store.ReplaceQuery(context.Background(), "test", "select 1", []uint{1, 2}))
+				} else {
+					assert.NoError(t, store.StopQuery("test"))
+				}
+			}(j%2 == 0)
+		}
+		wg.Wait()
+
+		// the query is either fully active or fully stopped
+		targetsExist, err := redigo.Bool(conn.Do("EXISTS", targetKey))
+		require.NoError(t, err)
+		sqlExists, err := redigo.Bool(conn.Do("EXISTS", sqlKey))
+		require.NoError(t, err)
+		isActive, err := redigo.Bool(conn.Do("SISMEMBER", activeQueriesKey, "test"))
+		require.NoError(t, err)
+		require.Equal(t, isActive, targetsExist)
+		require.Equal(t, isActive, sqlExists)
+
+		queries, err := store.QueriesForHost(1)
+		require.NoError(t, err)
+		if isActive {
+			require.Equal(t, map[string]string{"test": "select 1"}, queries)
+		} else {
+			require.Empty(t, queries)
+		}
+	}
+}
+
+func testLiveQueryRedisErrors(t *testing.T, store fleet.LiveQueryStore) {
+	pool := store.(*redisLiveQuery).pool
+	conn := redis.ConfigureDoer(pool, pool.Get())
+	defer conn.Close()
+
+	// store a value of the wrong type in the targets key of a query
+	targetKey, _ := generateKeys("test")
+	_, err := conn.Do("SADD", targetKey, "1")
+	require.NoError(t, err)
+
+	err = store.QueryCompletedByHost("test", 1)
+	require.ErrorIs(t, err, ErrRedisWrongType)
+	var rerr *RedisError
+	require.ErrorAs(t, err, &rerr)
+	require.Contains(t, err.Error(), "setbit query key")
+}
+
+func testLiveQueryRepairActiveQueries(t *testing.T, store fleet.LiveQueryStore) {
+	ctx := context.Background()
+	lq := store.(*redisLiveQuery)
+	conn := redis.ConfigureDoer(lq.pool, lq.pool.Get())
+	defer conn.Close()
+
+	require.NoError(t, store.RunQuery("1", "SELECT 1", []uint{1}))
+
+	// nothing to repair
+	added, removed, err := lq.RepairActiveQueries(ctx)
+	require.NoError(t, err)
+	require.Empty(t, added)
+	require.Empty(t, removed)
+
+	// plant a query that has its keys stored but is missing from the set
+	require.NoError(t, store.RunQuery("2", "SELECT 2", []uint{1}))
+	_, err = conn.Do("SREM", activeQueriesKey, "2")
+	require.NoError(t, err)
+	// and a stale name in the set
+	_, err = conn.Do("SADD", activeQueriesKey, "3")
+	require.NoError(t, err)
+	// keys without SQL are ignored
+	targetKey, _ := generateKeys("4")
+	_, err = conn.Do("SET", targetKey, "\xff")
+	require.NoError(t, err)
+
+	added, removed, err = lq.RepairActiveQueries(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"2"}, added)
+	require.Equal(t, []string{"3"}, removed)
+
+	activeNames, err := redigo.Strings(conn.Do("SMEMBERS", activeQueriesKey))
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"1", "2"}, activeNames)
+	queries, err := store.QueriesForHost(1)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"1": "SELECT 1", "2": "SELECT 2"}, queries)
+
+	// the cleanup of the inactive queries does not repair the set
+	_, err = conn.Do("SREM", activeQueriesKey, "2")
+	require.NoError(t, err)
+	require.NoError(t, store.CleanupInactiveQueries(ctx, nil))
+	require.NoError(t, store.CleanupInactiveQueries(ctx, []uint{3}))
+	activeNames, err = redigo.Strings(conn.Do("SMEMBERS", activeQueriesKey))
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"1"}, activeNames)
+
+	// the queries stopped while the set is repaired are not added back to it
+	var missing []string
+	for i := 10; i < 30; i++ {
+		name := strconv.Itoa(i)
+		require.NoError(t, store.RunQuery(name, "SELECT 1", []uint{1}))
+		_, err = conn.Do("SREM", activeQueriesKey, name)
+		require.NoError(t, err)
+		missing = append(missing, name)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for _, name := range missing {
+			assert.NoError(t, store.StopQuery(name))
+		}
+	}()
+	_, _, err = lq.RepairActiveQueries(ctx)
+	require.NoError(t, err)
+	wg.Wait()
+	activeNames, err = redigo.Strings(conn.Do("SMEMBERS", activeQueriesKey))
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"1", "2"}, activeNames)
+
+	// the SQL is checked when the name is added
+	targetKey, sqlKey := generateKeys("5")
+	_, err = conn.Do("SET", targetKey, "\xff")
+	require.NoError(t, err)
+	added, err = lq.addStoredQueryNames(ctx, []string{"5"})
+	require.NoError(t, err)
+	require.Empty(t, added)
+	_, err = conn.Do("SET", sqlKey, "SELECT 5")
+	require.NoError(t, err)
+	added, err = lq.addStoredQueryNames(ctx, []string{"5"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"5"}, added)
+}
+
+func testLiveQueryRunQueryContext(t *testing.T, store fleet.LiveQueryStore) {
+	ctx := context.Background()
+
+	require.NoError(t, store.RunQueryContext(ctx, "1", "SELECT 1", []uint{1}))
+
+	// a cancelled context fails without storing the query
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	err := store.RunQueryContext(cancelledCtx, "2", "SELECT 2", []uint{1})
+	require.ErrorIs(t, err, context.Canceled)
+
+	// an expired deadline fails without storing the query
+	deadlineCtx, cancel := context.WithDeadline(ctx, time.Now().Add(-time.Second))
+	defer cancel()
+	err = store.RunQueryContext(deadlineCtx, "3", "SELECT 3", []uint{1})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	queries, err := store.QueriesForHost(1)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"1": "SELECT 1"}, queries)
+}
+
+func testLiveQueryRunQueries(t *testing.T, store fleet.LiveQueryStore) {
+	ctx := context.Background()
+
+	require.NoError(t, store.RunQueries(ctx, nil))
+	require.NoError(t, store.RunQueries(ctx, []fleet.LiveQuerySpec{
+		{Name: "1", SQL: "SELECT 1", HostIDs: []uint{1, 2}},
+		{Name: "2", SQL: "SELECT 2", HostIDs: []uint{2}},
+		{Name: "3", SQL: "SELECT 3", HostIDs: []uint{3}},
+	}))
+
+	queries, err := store.QueriesForHost(2)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"1": "SELECT 1", "2": "SELECT 2"}, queries)
+	queries, err = store.QueriesForHost(3)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"3": "SELECT 3"}, queries)
+
+	// the invalid queries are reported and none of the queries is stored
+	err = store.RunQueries(ctx, []fleet.LiveQuerySpec{
+		{Name: "4", SQL: "SELECT 4", HostIDs: []uint{4}},
+		{Name: "5", SQL: "SELECT 5"},
+		{Name: "4", SQL: "SELECT 4 again", HostIDs: []uint{4}},
+		{Name: "6", SQL: strings.Repeat("a", defaultMaxSQLLength+1), HostIDs: []uint{4}},
+	})
+	var merr *multierror.Error
+	require.ErrorAs(t, err, &merr)
+	var failed []string
+	for _, err := range merr.Errors {
+		var specErr *SpecError
+		require.ErrorAs(t, err, &specErr)
+		failed = append(failed, specErr.Name)
+	}
+	require.Equal(t, []string{"5", "4", "6"}, failed)
+	require.ErrorIs(t, err, ErrSQLTooLong)
+
+	queries, err = store.QueriesForHost(4)
+	require.NoError(t, err)
+	require.Empty(t, queries)
+}
+
+func testLiveQueryRunQueryWithTTL(t *testing.T, store fleet.LiveQueryStore) {
+	ctx := context.Background()
+
+	require.Error(t, store.RunQueryWithTTL(ctx, "1", "SELECT 1", []uint{1}, 0))
+
+	require.NoError(t, store.RunQueryWithTTL(ctx, "1", "SELECT 1", []uint{1}, 200*time.Millisecond))
+	require.NoError(t, store.RunQuery("2", "SELECT 2", []uint{1}))
+
+	queries, err := store.QueriesForHost(1)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"1": "SELECT 1", "2": "SELECT 2"}, queries)
+
+	// once the TTL has elapsed, the query is not returned anymore
+	time.Sleep(300 * time.Millisecond)
+	queries, err = store.QueriesForHost(1)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"2": "SELECT 2"}, queries)
+
+	// the cleanup of the expired query still works
+	require.NoError(t, store.CleanupInactiveQueries(ctx, []uint{1}))
+	names, err := store.LoadActiveQueryNames()
+	require.NoError(t, err)
+	require.Equal(t, []string{"2"}, names)
+}
+
+func testLiveQueryQueriesForHostWithMeta(t *testing.T, store fleet.LiveQueryStore) {
+	queries, err := store.QueriesForHostWithMeta(1)
+	require.NoError(t, err)
+	require.Empty(t, queries)
+
+	start := time.Now()
+	require.NoError(t, store.RunQuery("1", "SELECT 1", []uint{1, 2, 3}))
+	require.NoError(t, store.RunQuery("2", "SELECT 2", []uint{1}))
+	require.NoError(t, store.RunQuery("3", "SELECT 3", []uint{2}))
+	require.NoError(t, store.QueryCompletedByHost("1", 2))
+
+	queries, err = store.QueriesForHostWithMeta(1)
+	require.NoError(t, err)
+	require.Len(t, queries, 2)
+	require.Equal(t, "SELECT 1", queries["1"].SQL)
+	require.EqualValues(t, 2, queries["1"].PendingHosts)
+	require.WithinDuration(t, start, queries["1"].CreatedAt, time.Minute)
+	require.Equal(t, "SELECT 2", queries["2"].SQL)
+	require.EqualValues(t, 1, queries["2"].PendingHosts)
+	require.WithinDuration(t, start, queries["2"].CreatedAt, time.Minute)
+
+	// the queries match those of QueriesForHost
+	sqlByName, err := store.QueriesForHost(1)
+	require.NoError(t, err)
+	for name, sql := range sqlByName {
+		require.Equal(t, sql, queries[name].SQL)
+	}
+
+	require.NoError(t, store.QueryCompletedByHost("2", 1))
+	queries, err = store.QueriesForHostWithMeta(1)
+	require.NoError(t, err)
+	require.Len(t, queries, 1)
+	require.EqualValues(t, 2, queries["1"].PendingHosts)
+}
+
+func testLiveQueryCompletionStats(t *testing.T, store fleet.LiveQueryStore) {
+	ctx := context.Background()
+
+	_, _, err := store.QueryCompletionStats(ctx, "1")
+	require.ErrorIs(t, err, ErrQueryNotFound)
+
+	require.NoError(t, store.RunQuery("1", "SELECT 1", []uint{1, 2, 3, 4, 5}))
+	total, completed, err := store.QueryCompletionStats(ctx, "1")
+	require.NoError(t, err)
+	require.Equal(t, 5, total)
+	require.Equal(t, 0, completed)
+
+	// completions of targeted hosts, of a host twice and of a host that is not
+	// targeted
+	require.NoError(t, store.QueryCompletedByHost("1", 1))
+	require.NoError(t, store.QueryCompletedByHost("1", 3))
+	require.NoError(t, store.QueryCompletedByHost("1", 3))
+	require.NoError(t, store.QueryCompletedByHost("1", 6))
+	total, completed, err = store.QueryCompletionStats(ctx, "1")
+	require.NoError(t, err)
+	require.Equal(t, 5, total)
+	require.Equal(t, 2, completed)
+
+	// running the query again resets the counters
+	require.NoError(t, store.ReplaceQuery(ctx, "1", "SELECT 1", []uint{1, 2}))
+	require.NoError(t, store.QueryCompletedByHost("1", 2))
+	total, completed, err = store.QueryCompletionStats(ctx, "1")
+	require.NoError(t, err)
+	require.Equal(t, 2, total)
+	require.Equal(t, 1, completed)
+
+	// completions of a stopped query are not counted
+	require.NoError(t, store.StopQuery("1"))
+	require.NoError(t, store.QueryCompletedByHost("1", 1))
+	_, _, err = store.QueryCompletionStats(ctx, "1")
+	require.ErrorIs(t, err, ErrQueryNotFound)
+}
+
+func testLiveQueryStopQueries(t *testing.T, store fleet.LiveQueryStore) {
+	ctx := context.Background()
+
+	require.NoError(t, store.StopQueries(ctx, nil))
+
+	require.NoError(t, store.RunQuery("1", "SELECT 1", []uint{1, 2}))
+	require.NoError(t, store.RunQuery("2", "SELECT 2", []uint{1}))
+	require.NoError(t, store.RunQuery("3", "SELECT 3", []uint{2}))
+
+	// stop a batch with a name that does not exist and a duplicate
+	require.NoError(t, store.StopQueries(ctx, []string{"1", "nosuchquery", "3", "1"}))
+
+	queries, err := store.QueriesForHost(1)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"2": "SELECT 2"}, queries)
+	queries, err = store.QueriesForHost(2)
+	require.NoError(t, err)
+	require.Empty(t, queries)
+	names, err := store.LoadActiveQueryNames()
+	require.NoError(t, err)
+	require.Equal(t, []string{"2"}, names)
+
+	// stopping them again is a no-op
+	require.NoError(t, store.StopQueries(ctx, []string{"1", "2", "3"}))
+	names, err = store.LoadActiveQueryNames()
+	require.NoError(t, err)
+	require.Empty(t, names)
+}
+
+func testLiveQueryActiveQueryNames(t *testing.T, store fleet.LiveQueryStore) {
+	ctx := context.Background()
+
+	names, err := store.ActiveQueryNames(ctx)
+	require.NoError(t, err)
+	require.Empty(t, names)
+
+	require.NoError(t, store.RunQuery("2", "SELECT 2", []uint{1}))
+	require.NoError(t, store.RunQuery("1", "SELECT 1", []uint{1, 2}))
+	require.NoError(t, store.RunQueryWithTTL(ctx, "3", "SELECT 3", []uint{2}, 100*time.Millisecond))
+	names, err = store.ActiveQueryNames(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"1", "2", "3"}, names)
+
+	require.NoError(t, store.StopQuery("2"))
+	names, err = store.ActiveQueryNames(ctx)
+	require.NoError(t, err)
+	require.NotContains(t, names, "2")
+
+	// the expired query is excluded even if it is still in the active set
+	time.Sleep(200 * time.Millisecond)
+	names, err = store.ActiveQueryNames(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"1"}, names)
+}
+
+func testLiveQueryQueryCompletedByHostContext(t *testing.T, store fleet.LiveQueryStore) {
+	ctx := context.Background()
+
+	require.NoError(t, store.RunQuery("1", "SELECT 1", []uint{1, 2}))
+
+	// a cancelled context aborts the operation
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	err := store.QueryCompletedByHostContext(cancelled, "1", 1)
+	require.ErrorIs(t, err, context.Canceled)
+	queries, err := store.QueriesForHost(1)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"1": "SELECT 1"}, queries)
+
+	require.NoError(t, store.QueryCompletedByHostContext(ctx, "1", 1))
+	queries, err = store.QueriesForHost(1)
+	require.NoError(t, err)
+	require.Empty(t, queries)
+	queries, err = store.QueriesForHost(2)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"1": "SELECT 1"}, queries)
+
+	total, completed, err := store.QueryCompletionStats(ctx, "1")
+	require.NoError(t, err)
+	require.Equal(t, 2, total)
+	require.Equal(t, 1, completed)
+}
+
+func testLiveQueryQueryExists(t *testing.T, store fleet.LiveQueryStore) {
+	ctx := context.Background()
+
+	// never created
+	ok, err := store.QueryExists(ctx, "1")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// present
+	require.NoError(t, store.RunQuery("1", "SELECT 1", []uint{1}))
+	require.NoError(t, store.RunQuery("2", "SELECT 2", []uint{1}))
+	ok, err = store.QueryExists(ctx, "1")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// still present once completed by all its hosts
+	require.NoError(t, store.QueryCompletedByHost("1", 1))
+	ok, err = store.QueryExists(ctx, "1")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// stopped
+	require.NoError(t, store.StopQuery("1"))
+	ok, err = store.QueryExists(ctx, "1")
+	require.NoError(t, err)
+	require.False(t, ok)
+	ok, err = store.QueryExists(ctx, "2")
+	require.NoError(t, err)
+	require.True(t, ok)
+}
+
+func testLiveQueryAlreadyRunning(t *testing.T, store fleet.LiveQueryStore) {
+	ctx := context.Background()
+
+	require.NoError(t, store.RunQuery("1", "SELECT 1", []uint{1}))
+
+	// running a query with the same name fails and does not change it
+	err := store.RunQuery("1", "SELECT 2", []uint{2})
+	require.ErrorIs(t, err, ErrQueryAlreadyRunning)
+	err = store.RunQueryContext(ctx, "1", "SELECT 2", []uint{2})
+	require.ErrorIs(t, err, ErrQueryAlreadyRunning)
+	err = store.RunQueries(ctx, []fleet.LiveQuerySpec{
+		{Name: "1", SQL: "SELECT 2", HostIDs: []uint{2}},
+		{Name: "2", SQL: "SELECT 2", HostIDs: []uint{2}},
+	})
+	require.ErrorIs(t, err, ErrQueryAlreadyRunning)
+	var specErr *SpecError
+	require.ErrorAs(t, err, &specErr)
+	require.Equal(t, "1", specErr.Name)
+
+	queries, err := store.QueriesForHost(1)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"1": "SELECT 1"}, queries)
+	queries, err = store.QueriesForHost(2)
+	require.NoError(t, err)
+	require.Empty(t, queries)
+
+	// replacing it overwrites it, and hosts that completed it receive the new
+	// query
+	require.NoError(t, store.QueryCompletedByHost("1", 1))
+	require.NoError(t, store.ReplaceQuery(ctx, "1", "SELECT 2", []uint{1, 2}))
+	for _, hostID := range []uint{1, 2} {
+		queries, err := store.QueriesForHost(hostID)
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{"1": "SELECT 2"}, queries)
+	}
+
+	// replacing a query that is not running starts it
+	require.NoError(t, store.ReplaceQuery(ctx, "3", "SELECT 3", []uint{3}))
+
+	// once stopped, the query can be run again
+	require.NoError(t, store.StopQuery("1"))
+	require.NoError(t, store.RunQuery("1", "SELECT 1", []uint{1}))
+	queries, err = store.QueriesForHost(1)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"1": "SELECT 1"}, queries)
+}
+
+func testLiveQueryPendingHostsForQuery(t *testing.T, store fleet.LiveQueryStore) {
+	ctx := context.Background()
+
+	_, err := store.PendingHostsForQuery(ctx, "1")
+	require.ErrorIs(t, err, ErrQueryNotFound)
+
+	hostIDs := []uint{1, 2, 7, 8, 9, 100, 1000, 1001, 5000}
+	require.NoError(t, store.RunQuery("1", "SELECT 1", hostIDs))
+	require.NoError(t, store.RunQuery("2", "SELECT 2", []uint{3}))
+	pending, err := store.PendingHostsForQuery(ctx, "1")
+	require.NoError(t, err)
+	require.Equal(t, hostIDs, pending)
+
+	// completions of targeted hosts and of a host that is not targeted
+	for _, id := range []uint{2, 8, 1000, 5000, 3} {
+		require.NoError(t, store.QueryCompletedByHost("1", id))
+	}
+	pending, err = store.PendingHostsForQuery(ctx, "1")
+	require.NoError(t, err)
+	require.Equal(t, []uint{1, 7, 9, 100, 1001}, pending)
+
+	// the other query is not affected
+	pending, err = store.PendingHostsForQuery(ctx, "2")
+	require.NoError(t, err)
+	require.Equal(t, []uint{3}, pending)
+
+	// once all hosts completed the query, none are pending
+	for _, id := range []uint{1, 7, 9, 100, 1001} {
+		require.NoError(t, store.QueryCompletedByHost("1", id))
+	}
+	pending, err = store.PendingHostsForQuery(ctx, "1")
+	require.NoError(t, err)
+	require.Empty(t, pending)
+
+	require.NoError(t, store.StopQuery("1"))
+	_, err = store.PendingHostsForQuery(ctx, "1")
+	require.ErrorIs(t, err, ErrQueryNotFound)
+}
+
+func testLiveQueryQueriesForHosts(t *testing.T, store fleet.LiveQueryStore) {
+	ctx := context.Background()
+
+	queries, err := store.QueriesForHosts(ctx, []uint{1, 2})
+	require.NoError(t, err)
+	require.Equal(t, map[uint]map[string]string{1: {}, 2: {}}, queries)
+
+	require.NoError(t, store.RunQuery("1", "SELECT 1", []uint{1, 3, 1000}))
+	require.NoError(t, store.RunQuery("2", "SELECT 2", []uint{3, 4}))
+	require.NoError(t, store.RunQuery("3", "SELECT 3", []uint{1000}))
+	require.NoError(t, store.QueryCompletedByHost("2", 4))
+
+	// hosts without queries, including one that completed its only query, get
+	// an empty map
+	queries, err = store.QueriesForHosts(ctx, []uint{1, 2, 3, 4, 1000, 3})
+	require.NoError(t, err)
+	require.Equal(t, map[uint]map[string]string{
+		1:    {"1": "SELECT 1"},
+		2:    {},
+		3:    {"1": "SELECT 1", "2": "SELECT 2"},
+		4:    {},
+		1000: {"1": "SELECT 1", "3": "SELECT 3"},
+	}, queries)
+
+	// same result as QueriesForHost
+	for hostID, want := range queries {
+		got, err := store.QueriesForHost(hostID)
+		require.NoError(t, err)
+		require.Equal(t, want, got, hostID)
+	}
+
+	queries, err = store.QueriesForHosts(ctx, nil)
+	require.NoError(t, err)
+	require.Empty(t, queries)
+}
+
+func testLiveQueryResetHostQueries(t *testing.T, store fleet.LiveQueryStore) {
+	ctx := context.Background()
+	lq := store.(*redisLiveQuery)
+	conn := redis.ConfigureDoer(lq.pool, lq.pool.Get())
+	defer conn.Close()
+
+	// by default, the completions of the queries stored in a bitfield are not
+	// recorded, so they cannot be reset
+	require.NoError(t, store.RunQuery("0", "SELECT 0", []uint{1}))
+	require.NoError(t, store.QueryCompletedByHost("0", 1))
+	require.ErrorIs(t, store.ResetHostQueries(ctx, 1), ErrResetUnsupported)
+	queries, err := store.QueriesForHost(1)
+	require.NoError(t, err)
+	require.Empty(t, queries)
+	bitKey, _ := lq.hostBitKey("0", 1)
+	n, err := redigo.Int(conn.Do("EXISTS", generateCompletedKey(bitKey)))
+	require.NoError(t, err)
+	require.Zero(t, n)
+	require.NoError(t, store.StopQuery("0"))
+
+	// same as WithResettableCompletions(true)
+	lq.resettableCompletions = true
+
+	require.NoError(t, store.RunQuery("1", "SELECT 1", []uint{1, 2, 1000}))
+	require.NoError(t, store.RunQuery("2", "SELECT 2", []uint{1}))
+	for _, hostID := range []uint{1, 2, 1000} {
+		require.NoError(t, store.QueryCompletedByHost("1", hostID))
+	}
+	require.NoError(t, store.QueryCompletedByHost("2", 1))
+
+	// resetting a host that completed no query, or that is not targeted, has
+	// no effect
+	require.NoError(t, store.ResetHostQueries(ctx, 3))
+	byHost, err := store.QueriesForHosts(ctx, []uint{1, 2, 3, 1000})
+	require.NoError(t, err)
+	require.Equal(t, map[uint]map[string]string{1: {}, 2: {}, 3: {}, 1000: {}}, byHost)
+
+	// the completed queries are returned again to the reset hosts only
+	require.NoError(t, store.ResetHostQueries(ctx, 1))
+	require.NoError(t, store.ResetHostQueries(ctx, 1000))
+	byHost, err = store.QueriesForHosts(ctx, []uint{1, 2, 3, 1000})
+	require.NoError(t, err)
+	require.Equal(t, map[uint]map[string]string{
+		1:    {"1": "SELECT 1", "2": "SELECT 2"},
+		2:    {},
+		3:    {},
+		1000: {"1": "SELECT 1"},
+	}, byHost)
+	_, completed, err := store.QueryCompletionStats(ctx, "1")
+	require.NoError(t, err)
+	require.Equal(t, 1, completed)
+	pending, err := store.PendingHostsForQuery(ctx, "1")
+	require.NoError(t, err)
+	require.Equal(t, []uint{1, 1000}, pending)
+
+	// the reset hosts can complete the queries again
+	require.NoError(t, store.QueryCompletedByHost("1", 1))
+	queries, err = store.QueriesForHost(1)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"2": "SELECT 2"}, queries)
+	_, completed, err = store.QueryCompletionStats(ctx, "1")
+	require.NoError(t, err)
+	require.Equal(t, 2, completed)
+
+	// running a query again also resets its completions
+	require.NoError(t, store.ReplaceQuery(ctx, "1", "SELECT 1", []uint{1, 2}))
+	require.NoError(t, store.ResetHostQueries(ctx, 2))
+	queries, err = store.QueriesForHost(2)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"1": "SELECT 1"}, queries)
+
+	// a stopped query is not returned again, and its completed hosts are
+	// removed
+	require.NoError(t, store.StopQuery("2"))
+	require.NoError(t, store.ResetHostQueries(ctx, 1))
+	queries, err = store.QueriesForHost(1)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"1": "SELECT 1"}, queries)
+
+	bitKey, _ = lq.hostBitKey("2", 1)
+	n, err = redigo.Int(conn.Do("EXISTS", bitKey, generateCompletedKey(bitKey)))
+	require.NoError(t, err)
+	require.Zero(t, n)
+}
@@ -0,0 +1,125 @@
+package live_query
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fleetdm/fleet/v4/server/datastore/redis"
+	"github.com/go-kit/log/level"
+	redigo "github.com/gomodule/redigo/redis"
+	"golang.org/x/sync/singleflight"
+)
+
+// ErrStoreMemoryExceeded is returned by RunQuery when the memory used by
+// Redis is over the high-water mark (see WithMemoryHighWaterMark).
+var ErrStoreMemoryExceeded = errors.New("live query store memory usage is over the high-water mark")
+
+// memoryGuard rejects the new queries when the memory used by Redis is over
+// the high-water mark. The memory usage is read at most once per cacheFor.
+type memoryGuard struct {
+	highWaterMark uint64
+	cacheFor      time.Duration
+	// reads the memory used by Redis, in bytes
+	read func() (uint64, error)
+	// merges the concurrent reads of the memory usage
+	reads singleflight.Group
+
+	// protects used and readAt, it is not held while the memory usage is read
+	mu     sync.Mutex
+	used   uint64
+	readAt time.Time
+}
+
+// WithMemoryHighWaterMark makes RunQuery fail with ErrStoreMemoryExceeded once
+// the memory used by Redis (the used_memory field of INFO memory, the largest
+// one of the primary nodes with Redis Cluster) is over maxBytes. The memory
+// usage is cached for cacheFor. QueriesForHost, QueryCompletedByHost and
+// StopQuery are not affected, so that running queries can complete and free
+// memory. If the memory usage cannot be read, the queries are accepted.
+func WithMemoryHighWaterMark(maxBytes uint64, cacheFor time.Duration) Option {
+	return func(r *redisLiveQuery) {
+		r.memory = &memoryGuard{
+			highWaterMark: maxBytes,
+			cacheFor:      cacheFor,
+			read:          r.readMemoryUsage,
+		}
+	}
+}
+
+// checkMemory returns an error wrapping ErrStoreMemoryExceeded if the memory
+// used by Redis is over the high-water mark.
+func (r *redisLiveQuery) checkMemory() error {
+	if r.memory == nil {
+		return nil
+	}
+
+	g := r.memory
+	now := r.clock()
+	g.mu.Lock()
+	used, readAt := g.used, g.readAt
+	g.mu.Unlock()
+
+	if readAt.IsZero() || now.Sub(readAt) >= g.cacheFor {
+		v, err, _ := g.reads.Do("", func() (interface{}, error) {
+			used, err := g.read()
+			if err != nil {
+				return nil, err
+			}
+			g.mu.Lock()
+			g.used, g.readAt = used, now
+			g.mu.Unlock()
+			return used, nil
+		})
+		if err != nil {
+			level.Warn(r.logger).Log("msg", "reading redis memory usage", "err", err)
+			return nil
+		}
+		used = v.(uint64)
+	}
+	if used > g.highWaterMark {
+		return fmt.Errorf("%w: %d bytes used, high-water mark is %d", ErrStoreMemoryExceeded, used, g.highWaterMark)
+	}
+	return nil
+}
+
+// readMemoryUsage returns the largest memory usage of the Redis primary
+// nodes.
+func (r *redisLiveQuery) readMemoryUsage() (uint64, error) {
+	var maxUsed uint64
+	err := redis.EachNode(r.pool, false, func(conn redigo.Conn) error {
+		info, err := redigo.String(conn.Do("INFO", "memory"))
+		if err != nil {
+			return fmt.Errorf("get memory info: %w", redisError(err))
+		}
+		used, err := parseUsedMemory(info)
+		if err != nil {
+			return err
+		}
+		maxUsed = max(maxUsed, used)
+		return nil
+	})
+	return maxUsed, err
+}
+
+// parseUsedMemory returns the value of the used_memory field of the INFO
+// memory reply.
+func parseUsedMemory(info string) (uint64, error) {
+	sc := bufio.NewScanner(strings.NewReader(info))
+	for sc.Scan() {
+		value, ok := strings.CutPrefix(strings.TrimSpace(sc.Text()), "used_memory:")
+		if !ok {
+			continue
+		}
+		used, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("parse used memory: %w", err)
+		}
+		return used, nil
+	}
+	return 0, errors.New("used memory not found in memory info")
+}
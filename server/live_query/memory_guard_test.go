@@ -0,0 +1,95 @@
+package live_query
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fleetdm/fleet/v4/server/datastore/redis/redistest"
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseUsedMemory(t *testing.T) {
+	used, err := parseUsedMemory("# Memory\r\nused_memory:1024\r\nused_memory_human:1.00K\r\nused_memory_rss:4096\r\n")
+	require.NoError(t, err)
+	require.EqualValues(t, 1024, used)
+
+	_, err = parseUsedMemory("# Memory\r\nused_memory_human:1.00K\r\n")
+	require.Error(t, err)
+
+	_, err = parseUsedMemory("used_memory:abc\r\n")
+	require.Error(t, err)
+}
+
+func TestCheckMemory(t *testing.T) {
+	now := time.Now()
+	store := NewRedisLiveQuery(redistest.NopRedis(), log.NewNopLogger(), 0, WithMemoryHighWaterMark(100, time.Second))
+	store.clock = func() time.Time { return now }
+
+	var reads int
+	var used uint64
+	var readErr error
+	store.memory.read = func() (uint64, error) {
+		reads++
+		return used, readErr
+	}
+
+	used = 100
+	require.NoError(t, store.checkMemory())
+	require.Equal(t, 1, reads)
+
+	// the memory usage is cached
+	used = 101
+	require.NoError(t, store.checkMemory())
+	require.Equal(t, 1, reads)
+
+	now = now.Add(time.Second)
+	err := store.checkMemory()
+	require.ErrorIs(t, err, ErrStoreMemoryExceeded)
+	require.Equal(t, 2, reads)
+
+	// the queries are accepted if the memory usage cannot be read
+	now = now.Add(time.Second)
+	readErr = errors.New("fail")
+	require.NoError(t, store.checkMemory())
+	require.Equal(t, 3, reads)
+
+	// the concurrent checks share the same read, which is not done while the
+	// cached memory usage is locked
+	now = now.Add(time.Second)
+	readErr = nil
+	used = 50
+	started, release := make(chan struct{}), make(chan struct{})
+	var blockedReads atomic.Int32
+	store.memory.read = func() (uint64, error) {
+		if blockedReads.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		return used, nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, store.checkMemory())
+		}()
+	}
+	<-started
+	store.memory.mu.Lock()
+	require.EqualValues(t, 101, store.memory.used)
+	store.memory.mu.Unlock()
+	close(release)
+	wg.Wait()
+	require.EqualValues(t, 1, blockedReads.Load())
+	require.EqualValues(t, 50, store.memory.used)
+
+	// no high-water mark
+	store = NewRedisLiveQuery(redistest.NopRedis(), log.NewNopLogger(), 0)
+	require.NoError(t, store.checkMemory())
+}
@@ -0,0 +1,64 @@
+package live_query
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/fleetdm/fleet/v4/server/datastore/redis"
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+// LiveQueryMetrics is a point-in-time view of the health of the live query
+// store, e.g. to include in support bundles. Apart from ActiveQueries, the
+// metrics are tracked by this Fleet instance since it started: with several
+// instances, they must be summed to get the totals of the deployment.
+type LiveQueryMetrics struct {
+	// ActiveQueries is the number of queries in the active queries set.
+	ActiveQueries int `json:"active_queries"`
+	// InstanceTargetedHosts is the total number of hosts targeted by the
+	// queries started by this instance.
+	InstanceTargetedHosts uint64 `json:"instance_targeted_hosts"`
+	// InstanceCompleted is the total number of completions of a query by a
+	// targeted host that had not completed it yet, recorded by this instance.
+	InstanceCompleted uint64 `json:"instance_completed"`
+	// OrphanEstimate is the number of queries in the active queries set that
+	// had expired the last time this instance loaded its cache.
+	OrphanEstimate int `json:"orphan_estimate"`
+	// DroppedCompletions is the number of completions that this instance
+	// could not send to the completion sink because its buffer was full.
+	DroppedCompletions uint64 `json:"dropped_completions"`
+}
+
+// storeCounters are the counters tracked by the store to compute the metrics
+// snapshot.
+type storeCounters struct {
+	targetedHosts atomic.Uint64
+	completed     atomic.Uint64
+	orphans       atomic.Int64
+}
+
+// MetricsSnapshot returns a snapshot of the metrics of the live query store.
+// Apart from the number of active queries which is read from Redis, it is
+// computed from counters tracked in memory.
+func (r *redisLiveQuery) MetricsSnapshot(ctx context.Context) (*LiveQueryMetrics, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	conn := redis.ReadOnlyConn(r.pool, r.pool.Get())
+	defer conn.Close()
+
+	active, err := redigo.Int(conn.Do("SCARD", activeQueriesKey))
+	if err != nil {
+		return nil, fmt.Errorf("count active queries: %w", redisError(err))
+	}
+
+	return &LiveQueryMetrics{
+		ActiveQueries:         active,
+		InstanceTargetedHosts: r.counters.targetedHosts.Load(),
+		InstanceCompleted:     r.counters.completed.Load(),
+		OrphanEstimate:        int(r.counters.orphans.Load()),
+		DroppedCompletions:    r.completions.droppedCount(),
+	}, nil
+}
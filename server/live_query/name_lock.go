@@ -0,0 +1,67 @@
+package live_query
+
+import (
+	"slices"
+	"sync"
+)
+
+// nameLocker serializes the mutations of the live queries that share the same
+// name, so that e.g. concurrent RunQuery and StopQuery calls for the same
+// campaign cannot interleave their Redis writes and leave the query partially
+// stored or partially removed. Note that this only serializes the calls made
+// by this process.
+type nameLocker struct {
+	mu    sync.Mutex
+	locks map[string]*nameLock
+}
+
+type nameLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// lock locks the provided name and returns the function to call to unlock
+// it.
+func (l *nameLocker) lock(name string) (unlock func()) {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*nameLock)
+	}
+	nl := l.locks[name]
+	if nl == nil {
+		nl = &nameLock{}
+		l.locks[name] = nl
+	}
+	nl.refs++
+	l.mu.Unlock()
+
+	nl.mu.Lock()
+	return func() {
+		nl.mu.Unlock()
+
+		l.mu.Lock()
+		nl.refs--
+		if nl.refs == 0 {
+			delete(l.locks, name)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// lockAll locks the provided names, in a consistent order so that concurrent
+// calls cannot deadlock, and returns the function to call to unlock them. The
+// names must be unique.
+func (l *nameLocker) lockAll(names []string) (unlock func()) {
+	sorted := slices.Clone(names)
+	slices.Sort(sorted)
+
+	unlocks := make([]func(), 0, len(sorted))
+	for _, name := range sorted {
+		unlocks = append(unlocks, l.lock(name))
+	}
+	return func() {
+		for _, unlock := range unlocks {
+			unlock()
+		}
+	}
+}
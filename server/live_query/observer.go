@@ -0,0 +1,42 @@
+package live_query
+
+import "time"
+
+// LiveQueryStoreObserver is notified of the duration and result of the
+// operations of the store (see WithObserver), e.g. to record latency and
+// error metrics. The methods are called synchronously once the operation
+// completes, so they must be fast and safe for concurrent use.
+type LiveQueryStoreObserver interface {
+	// ObserveRunQuery is called for each query started by RunQuery and its
+	// variants, and once for each batch started by RunQueries.
+	ObserveRunQuery(dur time.Duration, err error)
+	// ObserveStopQuery is called for each call to StopQuery, and once for
+	// each batch stopped by StopQueries.
+	ObserveStopQuery(dur time.Duration, err error)
+	// ObserveQueriesForHost is called for each call to QueriesForHost and
+	// QueriesForHostPlatform, and once for each batch of hosts of
+	// QueriesForHosts.
+	ObserveQueriesForHost(dur time.Duration, err error)
+	// ObserveQueryCompletedByHost is called for each call to
+	// QueryCompletedByHost and QueryCompletedByHostContext.
+	ObserveQueryCompletedByHost(dur time.Duration, err error)
+	// ObserveCleanupInactiveQueries is called for each call to
+	// CleanupInactiveQueries.
+	ObserveCleanupInactiveQueries(dur time.Duration, err error)
+}
+
+// WithObserver registers an observer that is notified of the duration and
+// result of the operations of the store. Without an observer, the operations
+// are not timed.
+func WithObserver(o LiveQueryStoreObserver) Option {
+	return func(r *redisLiveQuery) {
+		r.observer = o
+	}
+}
+
+// observe calls fn with the time elapsed since start and the error that err
+// points to. It is meant to be deferred at the start of an operation that has
+// a named error result, once the observer is known to be non-nil.
+func observe(fn func(time.Duration, error), start time.Time, err *error) {
+	fn(time.Since(start), *err)
+}
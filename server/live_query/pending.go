@@ -0,0 +1,159 @@
+package live_query
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+
+	"github.com/fleetdm/fleet/v4/server/contexts/ctxerr"
+	"github.com/fleetdm/fleet/v4/server/datastore/redis"
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+// PendingHostsForQuery returns the IDs of the hosts that are targeted by the
+// live query and did not complete it yet, in ascending order. The whole
+// targets of the query are read and decoded in memory, so it is intended for
+// bounded campaigns (e.g. to retry the stragglers of a campaign that targets
+// a few thousand hosts), not for queries that target the whole fleet. It
+// returns an error that wraps ErrQueryNotFound if the query does not exist,
+// and an error for the queries that target labels (see RunQueryForLabels), as
+// their targeted hosts are not known by the store.
+func (r *redisLiveQuery) PendingHostsForQuery(ctx context.Context, name string) ([]uint, error) {
+	conn := redis.ReadOnlyConn(r.pool, r.pool.Get())
+	defer conn.Close()
+
+	_, sqlKey := generateKeys(name)
+	if err := conn.Send("EXISTS", sqlKey); err != nil {
+		return nil, ctxerr.Wrap(ctx, redisError(err), "check query sql")
+	}
+	if err := conn.Send("HMGET", generateMetaKey(name), metaLazy, metaLabels, metaChunks); err != nil {
+		return nil, ctxerr.Wrap(ctx, redisError(err), "get query metadata")
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, ctxerr.Wrap(ctx, redisError(err), "flush pipeline")
+	}
+
+	exists, err := redigo.Bool(receiveContext(ctx, conn))
+	if err != nil {
+		return nil, ctxerr.Wrap(ctx, redisError(err), "receive query sql")
+	}
+	meta, err := redigo.Strings(receiveContext(ctx, conn))
+	if err != nil {
+		return nil, ctxerr.Wrap(ctx, redisError(err), "receive query metadata")
+	}
+	if !exists {
+		return nil, ctxerr.Wrap(ctx, ErrQueryNotFound, "pending hosts for query")
+	}
+
+	switch lazy, labels, chunks := meta[0] == "1", meta[1], meta[2]; {
+	case labels != "":
+		return nil, ctxerr.Wrap(ctx, errors.New("the query targets labels"), "pending hosts for query")
+	case lazy:
+		return pendingLazyHosts(ctx, conn, name)
+	case chunks != "":
+		idxs, err := parseChunkIndexes(chunks)
+		if err != nil {
+			return nil, ctxerr.Wrap(ctx, err, "pending hosts for query")
+		}
+		return r.pendingChunkHosts(ctx, conn, name, idxs)
+	default:
+		targetKey, _ := generateKeys(name)
+		bits, err := redigo.Bytes(doContext(ctx, conn, "GET", targetKey))
+		if err != nil && err != redigo.ErrNil {
+			return nil, ctxerr.Wrap(ctx, redisError(err), "get query targets")
+		}
+		return appendBitfieldHosts(nil, bits, 0), nil
+	}
+}
+
+// pendingChunkHosts returns the pending hosts of a query whose targets are
+// stored in the chunks at indexes idxs, in ascending order.
+func (r *redisLiveQuery) pendingChunkHosts(ctx context.Context, conn redigo.Conn, name string, idxs []uint) ([]uint, error) {
+	// the chunks are read in ascending order so that the hosts are appended in
+	// ascending order, the replies being received in the order of the commands.
+	sort.Slice(idxs, func(i, j int) bool { return idxs[i] < idxs[j] })
+	for _, idx := range idxs {
+		if err := conn.Send("GET", generateChunkKey(name, idx)); err != nil {
+			return nil, ctxerr.Wrap(ctx, redisError(err), "get targets chunk")
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, ctxerr.Wrap(ctx, redisError(err), "flush pipeline")
+	}
+
+	var hostIDs []uint
+	for _, idx := range idxs {
+		bits, err := redigo.Bytes(receiveContext(ctx, conn))
+		if err != nil && err != redigo.ErrNil {
+			return nil, ctxerr.Wrap(ctx, redisError(err), "receive targets chunk")
+		}
+		hostIDs = appendBitfieldHosts(hostIDs, bits, idx*r.chunkSize)
+	}
+	return hostIDs, nil
+}
+
+// pendingLazyHosts returns the pending hosts of a lazy query, in ascending
+// order.
+func pendingLazyHosts(ctx context.Context, conn redigo.Conn, name string) ([]uint, error) {
+	rangesKey, doneKey := generateLazyKeys(name)
+	if err := conn.Send("ZRANGE", rangesKey, 0, -1, "WITHSCORES"); err != nil {
+		return nil, ctxerr.Wrap(ctx, redisError(err), "get target ranges")
+	}
+	if err := conn.Send("SMEMBERS", doneKey); err != nil {
+		return nil, ctxerr.Wrap(ctx, redisError(err), "get completed hosts")
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, ctxerr.Wrap(ctx, redisError(err), "flush pipeline")
+	}
+
+	ranges, err := redigo.Strings(receiveContext(ctx, conn))
+	if err != nil {
+		return nil, ctxerr.Wrap(ctx, redisError(err), "receive target ranges")
+	}
+	done, err := redigo.Ints(receiveContext(ctx, conn))
+	if err != nil {
+		return nil, ctxerr.Wrap(ctx, redisError(err), "receive completed hosts")
+	}
+	completed := make(map[uint]bool, len(done))
+	for _, id := range done {
+		completed[uint(id)] = true
+	}
+
+	// the ranges are stored with their start as member and their end as score
+	// (see sendLazyTargets), and they are returned in ascending order.
+	var hostIDs []uint
+	for i := 0; i+1 < len(ranges); i += 2 {
+		start, err := strconv.ParseUint(ranges[i], 10, 0)
+		if err != nil {
+			return nil, ctxerr.Wrap(ctx, err, "parse target range start")
+		}
+		end, err := strconv.ParseUint(ranges[i+1], 10, 0)
+		if err != nil {
+			return nil, ctxerr.Wrap(ctx, err, "parse target range end")
+		}
+		for id := uint(start); id <= uint(end); id++ {
+			if !completed[id] {
+				hostIDs = append(hostIDs, id)
+			}
+		}
+	}
+	return hostIDs, nil
+}
+
+// appendBitfieldHosts appends to hostIDs the IDs of the hosts whose bit is set
+// in bits, the first bit being the one of host ID base. This is the reverse
+// of mapBitfield.
+func appendBitfieldHosts(hostIDs []uint, bits []byte, base uint) []uint {
+	for i, b := range bits {
+		if b == 0 {
+			continue
+		}
+		for j := uint(0); j < bitsInByte; j++ {
+			if b&(1<<(bitsInByte-1-j)) != 0 {
+				hostIDs = append(hostIDs, base+uint(i)*bitsInByte+j)
+			}
+		}
+	}
+	return hostIDs
+}
@@ -0,0 +1,194 @@
+package live_query
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/fleetdm/fleet/v4/server/contexts/ctxerr"
+	"github.com/fleetdm/fleet/v4/server/datastore/redis"
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+// QuerySortBy is the order in which ListQueriesDetailed returns the queries.
+type QuerySortBy string
+
+// List of supported sort orders for ListQueriesDetailed.
+const (
+	// SortByAge sorts the queries from the oldest to the newest.
+	SortByAge QuerySortBy = "age"
+	// SortBySize sorts the queries from the largest to the smallest.
+	SortBySize QuerySortBy = "size"
+)
+
+// QueryDetails are the details of an active live query.
+type QueryDetails struct {
+	Name string `json:"name"`
+	// CreatedAt is the time when the query was started, it is the zero time if
+	// unknown (e.g. the query was started by an older version of Fleet).
+	CreatedAt time.Time `json:"created_at"`
+	// Age is the time elapsed since CreatedAt according to the clock of this
+	// Fleet server. It is 0 if CreatedAt is in the future, e.g. if the query
+	// was started by a Fleet server whose clock is ahead.
+	Age time.Duration `json:"age"`
+	// SizeBytes is the memory used in Redis by the keys of the query (its
+	// targets, SQL, metadata and completed hosts) as reported by the MEMORY
+	// USAGE command.
+	SizeBytes int64 `json:"size_bytes"`
+}
+
+// ListQueriesDetailed returns the details of the active queries, sorted by
+// sortBy. If limit is > 0, at most limit queries are returned.
+func (r *redisLiveQuery) ListQueriesDetailed(ctx context.Context, sortBy QuerySortBy, limit int) ([]QueryDetails, error) {
+	if sortBy != SortByAge && sortBy != SortBySize {
+		return nil, ctxerr.Errorf(ctx, "invalid sort order: %q", sortBy)
+	}
+
+	names, err := r.readActiveQueryNames()
+	if err != nil {
+		return nil, ctxerr.Wrap(ctx, err, "read active queries")
+	}
+
+	keyNames := make([]string, 0, len(names))
+	for _, name := range names {
+		tkey, _ := generateKeys(name)
+		keyNames = append(keyNames, tkey)
+	}
+
+	now := r.clock()
+	details := make([]QueryDetails, 0, len(names))
+	for _, qkeys := range redis.SplitKeysBySlot(r.pool, keyNames...) {
+		batch, err := r.collectBatchQueryDetails(ctx, qkeys, now)
+		if err != nil {
+			return nil, ctxerr.Wrap(ctx, err, "collect query details")
+		}
+		details = append(details, batch...)
+	}
+
+	sort.Slice(details, func(i, j int) bool {
+		a, b := details[i], details[j]
+		switch sortBy {
+		case SortBySize:
+			if a.SizeBytes != b.SizeBytes {
+				return a.SizeBytes > b.SizeBytes
+			}
+		case SortByAge:
+			if a.Age != b.Age {
+				return a.Age > b.Age
+			}
+		}
+		return a.Name < b.Name
+	})
+	if limit > 0 && len(details) > limit {
+		details = details[:limit]
+	}
+	return details, nil
+}
+
+// memoryUsage returns the memory used by the keys whose MEMORY USAGE replies
+// are received from conn, the keys that do not exist are ignored.
+func memoryUsage(ctx context.Context, conn redigo.Conn, count int) (int64, error) {
+	var total int64
+	for i := 0; i < count; i++ {
+		n, err := redigo.Int64(receiveContext(ctx, conn))
+		if err != nil && err != redigo.ErrNil {
+			return 0, fmt.Errorf("receive memory usage: %w", redisError(err))
+		}
+		total += n
+	}
+	return total, nil
+}
+
+func (r *redisLiveQuery) collectBatchQueryDetails(ctx context.Context, queryKeys []string, now time.Time) ([]QueryDetails, error) {
+	conn := redis.ReadOnlyConn(r.pool, r.pool.Get())
+	defer conn.Close()
+
+	// the HMGET is sent first so that the connection is bound to the slot of
+	// the query keys in Redis Cluster, the first argument of MEMORY USAGE is
+	// not a key.
+	for _, key := range queryKeys {
+		name := extractTargetKeyName(key)
+		if err := conn.Send("HMGET", generateMetaKey(name), metaCreatedAt, metaChunks); err != nil {
+			return nil, fmt.Errorf("get query metadata: %w", redisError(err))
+		}
+		for _, k := range allQueryKeys(name) {
+			if err := conn.Send("MEMORY", "USAGE", k); err != nil {
+				return nil, fmt.Errorf("get query memory usage: %w", redisError(err))
+			}
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, fmt.Errorf("flush pipeline: %w", redisError(err))
+	}
+
+	details := make([]QueryDetails, 0, len(queryKeys))
+	chunkKeys := make([][]string, 0, len(queryKeys))
+	for _, key := range queryKeys {
+		name := extractTargetKeyName(key)
+		meta, err := redigo.Strings(receiveContext(ctx, conn))
+		if err != nil {
+			return nil, fmt.Errorf("receive query metadata: %w", redisError(err))
+		}
+		size, err := memoryUsage(ctx, conn, len(allQueryKeys(name)))
+		if err != nil {
+			return nil, err
+		}
+
+		// the chunks are listed in the metadata of the query, so they are
+		// found even if it was stored with a different chunk size than the
+		// one of this instance.
+		createdAt, chunks := meta[0], meta[1]
+		keys, err := parseChunkKeys(name, chunks)
+		if err != nil {
+			return nil, err
+		}
+		var withCompleted []string
+		for _, k := range keys {
+			withCompleted = append(withCompleted, k, generateCompletedKey(k))
+		}
+
+		d := QueryDetails{Name: name, SizeBytes: size}
+		if createdAt != "" {
+			nanos, err := strconv.ParseInt(createdAt, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("parse creation time: %w", err)
+			}
+			d.CreatedAt = time.Unix(0, nanos)
+			d.Age = max(now.Sub(d.CreatedAt), 0)
+		}
+		details = append(details, d)
+		chunkKeys = append(chunkKeys, withCompleted)
+	}
+
+	var hasChunks bool
+	for _, keys := range chunkKeys {
+		for _, k := range keys {
+			hasChunks = true
+			if err := conn.Send("MEMORY", "USAGE", k); err != nil {
+				return nil, fmt.Errorf("get chunk memory usage: %w", redisError(err))
+			}
+		}
+	}
+	if hasChunks {
+		if err := conn.Flush(); err != nil {
+			return nil, fmt.Errorf("flush pipeline: %w", redisError(err))
+		}
+	}
+
+	// the query may have expired or been stopped since the active set was
+	// read.
+	kept := details[:0]
+	for i, d := range details {
+		size, err := memoryUsage(ctx, conn, len(chunkKeys[i]))
+		if err != nil {
+			return nil, err
+		}
+		d.SizeBytes += size
+		if d.SizeBytes > 0 {
+			kept = append(kept, d)
+		}
+	}
+	return kept, nil
+}
@@ -31,6 +31,52 @@
 //	sql:livequery:<ID> is the SQL of the query.
 //	livequery:active is the set containing the active live query IDs
 //
+// Optionally, a live query can be restricted to some platforms, in which case
+// a fourth key stores the comma-separated list of platforms:
+//
+//	platforms:livequery:<ID> is the list of platforms of the query.
+//
+// Finally, a hash stores metadata about the query, such as its creation time:
+//
+//	meta:livequery:<ID> is the metadata of the query.
+//
+// If the store is configured with a bitfield chunk size (see
+// WithBitfieldChunkSize), the bitfield is split in chunks of that size and
+// only the chunks that target at least one host are stored, the bitfield key
+// is then empty and the indexes of the chunks are listed in the metadata:
+//
+//	livequery:<ID>:<N> is the chunk N of the bitfield.
+//
+// When a host completes a query, its bit is cleared from the bitfield. If the
+// store is configured to record the completions (see
+// WithResettableCompletions), the bit is also set in a second bitfield so that
+// the completion can be reset (see ResetHostQueries):
+//
+//	completed:livequery:<ID> is the bitfield of the hosts that completed it.
+//	completed:livequery:<ID>:<N> is the chunk N of that bitfield.
+//
+// That second bitfield grows up to the highest ID of the hosts that completed
+// the query, so it can use as much memory as the targets bitfield, and each
+// completion then runs a script of up to 7 commands instead of a SETBIT.
+//
+// A query started with RunQueryLazy does not use the bitfield either, the
+// ranges of targeted host IDs and the hosts that completed the query are
+// stored instead:
+//
+//	ranges:livequery:<ID> is the sorted set of the ranges of host IDs.
+//	done:livequery:<ID> is the set of the hosts that completed the query.
+//
+// A query started with RunQueryForLabels only uses the set of the hosts that
+// completed the query, the targeted labels are listed in the metadata and the
+// labels of the host are resolved when its queries are read.
+//
+// The creation time of a query is recorded with the clock of the Fleet server
+// that started it, and its age is computed with the clock of the Fleet server
+// that reads it, so the clocks of the Fleet servers are assumed to be
+// synchronized; negative ages due to clock skew are reported as 0. The
+// expiration of the keys is managed by Redis with relative TTLs, so it is not
+// affected by clock skew.
+//
 // Both the bitfield and sql keys have an expiration, and <ID> is the campaign
 // ID of the query.  To make efficient use of Redis Cluster (without impacting
 // standalone Redis), the <ID> is stored in braces (hash tags, e.g.
@@ -48,9 +94,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fleetdm/fleet/v4/server/contexts/ctxerr"
@@ -65,10 +113,55 @@ const (
 	bitsInByte       = 8
 	queryKeyPrefix   = "livequery:"
 	sqlKeyPrefix     = "sql:"
+	platformsPrefix  = "platforms:"
+	metaPrefix       = "meta:"
 	activeQueriesKey = "livequery:active"
 	queryExpiration  = 7 * 24 * time.Hour
+
+	// fields of the metadata hash
+	metaCreatedAt = "created_at"
+	metaTargeted  = "targeted"
+	metaCompleted = "completed"
+	metaPriority  = "priority"
+
+	// defaultMaxSQLLength is the default maximum length in bytes of the SQL
+	// of a live query (see WithMaxSQLLength).
+	defaultMaxSQLLength = 1 << 20 // 1MB
+
+	// defaultMaxTargetedHosts is the default maximum number of hosts targeted
+	// by a live query (see WithMaxTargetedHosts).
+	defaultMaxTargetedHosts = 1_000_000
+
+	// maxSQLCacheSize is the maximum number of queries for which the SQL is
+	// kept in the in-memory cache. Queries beyond that limit are still served,
+	// their SQL is read from Redis when needed.
+	maxSQLCacheSize = 10_000
 )
 
+// ErrReadOnly is returned by the operations that create or remove live queries
+// when the store is in read-only mode.
+var ErrReadOnly = errors.New("live query store is in read-only mode")
+
+// ErrSQLTooLong is returned by RunQuery when the SQL of the query exceeds the
+// maximum length.
+var ErrSQLTooLong = errors.New("live query SQL is too long")
+
+// ErrQueryTooLarge is an alias of ErrSQLTooLong.
+var ErrQueryTooLarge = ErrSQLTooLong
+
+// ErrQueryAlreadyRunning is returned by RunQuery when a query with the same
+// name is already running. ReplaceQuery must be used to overwrite it.
+var ErrQueryAlreadyRunning = errors.New("live query is already running")
+
+// ErrTooManyTargets is returned by RunQuery when the query targets more hosts
+// than the maximum.
+var ErrTooManyTargets = errors.New("live query targets too many hosts")
+
+// ErrResetUnsupported is returned by ResetHostQueries when the completions of
+// some of the active queries are not recorded, so they cannot be reset (see
+// WithResettableCompletions).
+var ErrResetUnsupported = errors.New("live query completions are not recorded")
+
 type redisLiveQuery struct {
 	// connection pool
 	pool fleet.RedisPool
@@ -76,18 +169,89 @@ type redisLiveQuery struct {
 	cache memCache
 	// in memory cache expiration
 	cacheExpiration time.Duration
+	// dispatch counters used to report the hot queries
+	hotQueries hotQueriesCounter
+	// serializes the mutations of a given query
+	nameLocks nameLocker
+	// maximum duration of a CleanupInactiveQueries call, <= 0 means no limit
+	cleanupMaxDuration time.Duration
+	// when true, CleanupInactiveQueries logs the names of the removed queries
+	cleanupLogRemoved bool
+	// when true, the mutations of the live queries are rejected
+	readOnly atomic.Bool
+	// limits the number of queries returned to a host on each check-in
+	hostCap hostQueriesCap
+	// counters used for the metrics snapshot
+	counters storeCounters
+	// notifies the completion sink, nil if there is none
+	completions *completionNotifier
+	// stops the background tasks started by Start, nil if not started
+	stopBackground context.CancelFunc
+	// tracks the background tasks started by Start
+	background sync.WaitGroup
+	// notified of the duration and result of the operations, nil if there
+	// is none
+	observer LiveQueryStoreObserver
+	// resolves the labels of a host for the queries that target labels, nil
+	// if there is none
+	labelResolver LabelMembershipResolver
+	// counts the hosts targeted by the queries that target labels, nil if
+	// there is none
+	labelHostsCounter LabelHostsCounter
+	// maximum length of the SQL of a query, <= 0 means no limit
+	maxSQLLength int
+	// maximum number of hosts targeted by a query, <= 0 means no limit
+	maxTargetedHosts int
+	// returns the current time, it is time.Now except in tests
+	clock func() time.Time
+	// rejects the new queries when Redis uses too much memory, nil if there
+	// is no high-water mark
+	memory *memoryGuard
+	// number of bits of the chunks of the targets bitfields, 0 means that the
+	// targets are stored in a single bitfield
+	chunkSize uint
+	// when true, the completions of the queries stored in a bitfield are
+	// recorded so that they can be reset
+	resettableCompletions bool
 
 	logger kitlog.Logger
 }
 
+// Option is an option that can be passed to NewRedisLiveQuery to configure
+// the live query store.
+type Option func(*redisLiveQuery)
+
 // memCache is an in-memory cache for live queries. It stores the SQL of the
 // queries and the active queries set. It also stores the expiration time of the
 // cache.
+//
+// The SQL of a query never changes for a given name unless RunQuery is called
+// again for that name, so when the cache is reloaded the SQL already cached is
+// reused instead of being fetched again from Redis, once a single pipeline
+// confirmed that the queries were not stopped nor run again since they were
+// cached, possibly by another instance. The other queries are read with a
+// single pipeline per cluster slot. RunQuery and StopQuery invalidate the
+// entry for their name and record the version at which it was invalidated, so
+// that a reload that raced with an invalidation does not write back the
+// (possibly stale) entry that it read.
 type memCache struct {
-	sqlCache           map[string]string
+	sqlCache map[string]string
+	// platforms of the queries restricted to some platforms, for the queries
+	// that are in sqlCache.
+	platformsCache map[string][]string
+	// queryMetas holds for each active query the metadata needed to
+	// dispatch it, e.g. how its targets are stored.
+	queryMetas         map[string]queryMeta
 	activeQueriesCache []string
 	cacheExp           time.Time
-	mu                 sync.RWMutex
+	// version is incremented each time an entry is invalidated.
+	version uint64
+	// invalidated holds the version at which each entry was invalidated since
+	// the last reload.
+	invalidated map[string]uint64
+	mu          sync.RWMutex
+	// loadMu serializes the reloads of the cache.
+	loadMu sync.Mutex
 }
 
 // cacheIsExpired is a thread-safe method to check if the cache is expired.
@@ -106,21 +270,181 @@ func (r *redisLiveQuery) getSQLByCampaignID(campaignID string) (string, bool) {
 	return sql, found
 }
 
+// getPlatformsByCampaignID is a thread-safe method to get the platforms of a
+// live query by its campaign ID.
+func (r *redisLiveQuery) getPlatformsByCampaignID(campaignID string) []string {
+	r.cache.mu.RLock()
+	defer r.cache.mu.RUnlock()
+	return r.cache.platformsCache[campaignID]
+}
+
+// setSQLByCampaignID is a thread-safe method to store the SQL and platforms of
+// a live query read from Redis in the cache. They are only stored if the cache
+// was not invalidated since version was read and if the cache is not full.
+func (r *redisLiveQuery) setSQLByCampaignID(campaignID, sql string, platforms []string, version uint64) {
+	r.cache.mu.Lock()
+	defer r.cache.mu.Unlock()
+	if r.cache.version != version || len(r.cache.sqlCache) >= maxSQLCacheSize {
+		return
+	}
+	r.cache.sqlCache[campaignID] = sql
+	if len(platforms) > 0 {
+		r.cache.platformsCache[campaignID] = platforms
+	}
+}
+
+// cacheVersion is a thread-safe method to get the current version of the
+// cache.
+func (r *redisLiveQuery) cacheVersion() uint64 {
+	r.cache.mu.RLock()
+	defer r.cache.mu.RUnlock()
+	return r.cache.version
+}
+
+// invalidateCache is a thread-safe method to remove the cached SQL of a live
+// query. If stopped is true, the query is also removed from the cached active
+// queries. The query was run or stopped, so the rotation offsets of the hosts
+// over the cap are reset.
+func (r *redisLiveQuery) invalidateCache(campaignID string, stopped bool) {
+	defer r.hostCap.reset()
+
+	r.cache.mu.Lock()
+	defer r.cache.mu.Unlock()
+
+	delete(r.cache.sqlCache, campaignID)
+	delete(r.cache.platformsCache, campaignID)
+	r.cache.version++
+	r.cache.invalidated[campaignID] = r.cache.version
+
+	if stopped {
+		delete(r.cache.queryMetas, campaignID)
+		names := make([]string, 0, len(r.cache.activeQueriesCache))
+		for _, name := range r.cache.activeQueriesCache {
+			if name != campaignID {
+				names = append(names, name)
+			}
+		}
+		r.cache.activeQueriesCache = names
+	}
+}
+
+// WithMaxSQLLength sets the maximum length in bytes of the SQL of a live
+// query, RunQuery fails with ErrSQLTooLong if it is exceeded. It defaults to
+// 1MB, a value <= 0 means no limit.
+func WithMaxSQLLength(n int) Option {
+	return func(r *redisLiveQuery) {
+		r.maxSQLLength = n
+	}
+}
+
+// WithMaxTargetedHosts sets the maximum number of hosts targeted by a live
+// query, RunQuery fails with ErrTooManyTargets if it is exceeded. It defaults
+// to 1,000,000, a value <= 0 means no limit.
+func WithMaxTargetedHosts(n int) Option {
+	return func(r *redisLiveQuery) {
+		r.maxTargetedHosts = n
+	}
+}
+
+// WithCleanupMaxDuration sets the maximum duration of a CleanupInactiveQueries
+// call. Once exceeded, the cleanup stops after the current batch and the
+// remaining inactive queries are left for the next run.
+func WithCleanupMaxDuration(d time.Duration) Option {
+	return func(r *redisLiveQuery) {
+		r.cleanupMaxDuration = d
+	}
+}
+
+// WithCleanupLogRemoved enables the logging of the names of the queries
+// removed by CleanupInactiveQueries and RepairActiveQueries, e.g. to
+// investigate queries that disappeared unexpectedly. See also
+// CleanupInactiveQueriesDryRun.
+func WithCleanupLogRemoved(enabled bool) Option {
+	return func(r *redisLiveQuery) {
+		r.cleanupLogRemoved = enabled
+	}
+}
+
+// SetReadOnly enables or disables the read-only mode of the store, e.g. during
+// a Redis failover or migration. In read-only mode, RunQuery, StopQuery,
+// ResetHostQueries, CleanupInactiveQueries and RepairActiveQueries fail with
+// ErrReadOnly, while QueriesForHost, LoadActiveQueryNames and
+// QueryCompletedByHost keep working so that hosts still receive and complete
+// the queries that are already running. The cron jobs that clean up and
+// repair the live queries are skipped.
+func (r *redisLiveQuery) SetReadOnly(readOnly bool) {
+	r.readOnly.Store(readOnly)
+}
+
 // NewRedisQueryResults creates a new Redis implementation of the
 // QueryResultStore interface using the provided Redis connection pool.
-func NewRedisLiveQuery(pool fleet.RedisPool, logger kitlog.Logger, memCacheExp time.Duration) *redisLiveQuery {
-	return &redisLiveQuery{
-		pool:            pool,
-		cache:           newMemCache(),
-		cacheExpiration: memCacheExp,
-		logger:          logger,
+func NewRedisLiveQuery(pool fleet.RedisPool, logger kitlog.Logger, memCacheExp time.Duration, opts ...Option) *redisLiveQuery {
+	r := &redisLiveQuery{
+		pool:             pool,
+		cache:            newMemCache(),
+		cacheExpiration:  memCacheExp,
+		logger:           logger,
+		maxSQLLength:     defaultMaxSQLLength,
+		maxTargetedHosts: defaultMaxTargetedHosts,
+		clock:            time.Now,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Start starts the background tasks of the store, they stop when ctx is done
+// or when Close is called. It logs the hot queries report if
+// WithHotQueriesReport is set, and notifies the sink registered with
+// WithCompletionSink. It must be called at most once.
+func (r *redisLiveQuery) Start(ctx context.Context) {
+	ctx, r.stopBackground = context.WithCancel(ctx)
+	if r.hotQueries.enabled() {
+		r.background.Add(1)
+		go func() {
+			defer r.background.Done()
+			r.runHotQueriesReport(ctx)
+		}()
+	}
+	if r.completions != nil {
+		r.background.Add(1)
+		go func() {
+			defer r.background.Done()
+			r.completions.run(ctx)
+		}()
+	}
+}
+
+// Close stops the background tasks started by Start, and waits until the
+// completions that are buffered are delivered to the sink or until ctx is
+// done.
+func (r *redisLiveQuery) Close(ctx context.Context) error {
+	if r.stopBackground == nil {
+		return nil
+	}
+	r.stopBackground()
+
+	done := make(chan struct{})
+	go func() {
+		r.background.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
 func newMemCache() memCache {
 	return memCache{
 		sqlCache:           make(map[string]string),
+		platformsCache:     make(map[string][]string),
+		queryMetas:         make(map[string]queryMeta),
 		activeQueriesCache: make([]string, 0),
+		invalidated:        make(map[string]uint64),
 	}
 }
 
@@ -132,6 +456,25 @@ func generateKeys(name string) (targetsKey, sqlKey string) {
 	return queryKeyPrefix + keyTag, sqlKeyPrefix + queryKeyPrefix + keyTag
 }
 
+// generate the key for the platforms of a query, it uses the same key tag as
+// the other keys of the query.
+func generatePlatformsKey(name string) string {
+	return platformsPrefix + queryKeyPrefix + "{" + name + "}"
+}
+
+// generate the key for the metadata hash of a query, it uses the same key tag
+// as the other keys of the query.
+func generateMetaKey(name string) string {
+	return metaPrefix + queryKeyPrefix + "{" + name + "}"
+}
+
+// returns all the keys that store information about a query.
+func allQueryKeys(name string) []string {
+	targetKey, sqlKey := generateKeys(name)
+	rangesKey, doneKey := generateLazyKeys(name)
+	return []string{targetKey, sqlKey, generatePlatformsKey(name), generateMetaKey(name), rangesKey, doneKey, generateCompletedKey(targetKey)}
+}
+
 // returns the base name part of a target key, i.e. so that this is true:
 //
 //	tkey, _ := generateKeys(name)
@@ -148,30 +491,184 @@ func extractTargetKeyName(key string) string {
 	return name
 }
 
+// returns the base name part of a metadata key.
+func extractMetaKeyName(key string) string {
+	return extractTargetKeyName(strings.TrimPrefix(key, metaPrefix))
+}
+
 // RunQuery stores the live query information in ephemeral storage for the
 // duration of the query or its TTL. Note that hostIDs *must* be sorted
-// in ascending order. The name is the campaign ID as a string.
+// in ascending order. The name is the campaign ID as a string. It fails with
+// ErrQueryAlreadyRunning if a query with that name is already running, as do
+// all the variants of RunQuery except ReplaceQuery. This is only checked
+// before storing the query, so concurrent calls by different Fleet instances
+// may still overwrite each other.
 func (r *redisLiveQuery) RunQuery(name, sql string, hostIDs []uint) error {
-	if len(hostIDs) == 0 {
+	return r.RunQueryContext(context.Background(), name, sql, hostIDs)
+}
+
+// RunQueryContext is like RunQuery, but the Redis operations are bounded by
+// ctx: it fails with the error of ctx once it is done. With Redis Cluster, an
+// operation that was already sent to Redis is not interrupted.
+func (r *redisLiveQuery) RunQueryContext(ctx context.Context, name, sql string, hostIDs []uint) error {
+	return r.runQuery(ctx, queryInfo{name: name, sql: sql, hostIDs: hostIDs})
+}
+
+// ReplaceQuery is like RunQueryContext, but if a query with the same name is
+// already running, it is overwritten instead of failing with
+// ErrQueryAlreadyRunning. The hosts that completed the previous query receive
+// the new one if they are targeted.
+func (r *redisLiveQuery) ReplaceQuery(ctx context.Context, name, sql string, hostIDs []uint) error {
+	return r.runQuery(ctx, queryInfo{name: name, sql: sql, hostIDs: hostIDs, replace: true})
+}
+
+// RunQueryWithTTL is like RunQueryContext, but the query expires after ttl
+// instead of the default 7 days, so that it does not linger if its campaign
+// is lost. It is a backstop: CleanupInactiveQueries still removes the queries
+// of the inactive campaigns before they expire. Once expired, the query is not
+// returned by QueriesForHost anymore and its name is eventually removed from
+// the active queries (see loadCache).
+func (r *redisLiveQuery) RunQueryWithTTL(ctx context.Context, name, sql string, hostIDs []uint, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("invalid TTL: %s", ttl)
+	}
+	return r.runQuery(ctx, queryInfo{name: name, sql: sql, hostIDs: hostIDs, ttl: ttl})
+}
+
+// RunQueryWithPriority is like RunQueryContext, but the query has the given
+// priority, 0 being the priority of the queries started by the other methods.
+// When a host is targeted by more queries than the cap set by
+// WithMaxQueriesPerHost, the queries with the highest priorities are returned
+// first, and the queries of the same priority are selected as set by
+// WithHostQueriesCapOrder. Without a cap, all the queries are returned and
+// the priority has no effect.
+func (r *redisLiveQuery) RunQueryWithPriority(ctx context.Context, name, sql string, hostIDs []uint, priority int) error {
+	return r.runQuery(ctx, queryInfo{name: name, sql: sql, hostIDs: hostIDs, priority: priority})
+}
+
+// RunQueryForPlatforms is like RunQuery, but the query is only returned to
+// the hosts of the provided platforms, even if other hosts are targeted. A
+// platform can be a specific host platform (e.g. "ubuntu") or a platform
+// family as returned by fleet.PlatformFromHost (e.g. "linux"). Such queries
+// are only returned by QueriesForHostPlatform, as QueriesForHost does not know
+// the platform of the host.
+func (r *redisLiveQuery) RunQueryForPlatforms(name, sql string, hostIDs []uint, platforms []string) error {
+	return r.runQuery(context.Background(), queryInfo{name: name, sql: sql, hostIDs: hostIDs, platforms: platforms})
+}
+
+// validateQuery returns an error if the query cannot be stored. Only the
+// name, SQL and targets of info are used.
+func (r *redisLiveQuery) validateQuery(info queryInfo) error {
+	if len(info.hostIDs) == 0 && len(info.labels) == 0 {
 		return errors.New("no hosts targeted")
 	}
+	if r.maxTargetedHosts > 0 && len(info.hostIDs) > r.maxTargetedHosts {
+		return fmt.Errorf("%w: %d hosts, maximum is %d", ErrTooManyTargets, len(info.hostIDs), r.maxTargetedHosts)
+	}
+	if r.maxSQLLength > 0 && len(info.sql) > r.maxSQLLength {
+		return fmt.Errorf("%w: %d bytes, maximum is %d", ErrSQLTooLong, len(info.sql), r.maxSQLLength)
+	}
+	return nil
+}
 
-	// store the sql and targeted hosts information
-	if err := r.storeQueryInfo(name, sql, hostIDs); err != nil {
-		return fmt.Errorf("store query info: %w", err)
+// runQuery stores the query described by info, the fields that are not about
+// the query itself (e.g. createdAt) are set by runQuery.
+func (r *redisLiveQuery) runQuery(ctx context.Context, info queryInfo) (err error) {
+	if o := r.observer; o != nil {
+		defer observe(o.ObserveRunQuery, time.Now(), &err)
 	}
 
-	// store name (campaign id) into the active live queries set
-	if err := r.storeQueryNames(name); err != nil {
-		return fmt.Errorf("store query name: %w", err)
+	if err := r.validateQuery(info); err != nil {
+		return err
+	}
+	if r.readOnly.Load() {
+		return ErrReadOnly
+	}
+	if err := r.checkMemory(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := r.nameLocks.lock(info.name)
+	defer unlock()
+
+	if !info.replace {
+		running, err := r.sqlExists(ctx, info.name)
+		if err != nil {
+			return fmt.Errorf("check running query: %w", err)
+		}
+		if running {
+			return fmt.Errorf("%w: %s", ErrQueryAlreadyRunning, info.name)
+		}
 	}
 
+	// the SQL may have changed if the query is being run again, invalidate
+	// once it is stored so that a concurrent reload does not cache the old one.
+	defer r.invalidateCache(info.name, false)
+
+	// the chunks of a previous run of the query may not all be overwritten
+	chunkKeys, err := r.queryChunkKeys(ctx, info.name)
+	if err != nil {
+		return fmt.Errorf("read previous query chunks: %w", err)
+	}
+
+	info.createdAt = r.clock()
+	info.chunkSize = r.chunkSize
+	info.staleKeys = chunkKeys[info.name]
+	if err := r.storeQuery(ctx, info); err != nil {
+		return err
+	}
+	r.setQueryMeta(info.name, queryMeta{lazy: info.lazy, labels: info.labels, createdAt: info.createdAt, priority: info.priority})
+	r.counters.targetedHosts.Add(uint64(info.targetedHosts()))
+
 	return nil
 }
 
-func (r *redisLiveQuery) StopQuery(name string) error {
+func (r *redisLiveQuery) StopQuery(name string) (err error) {
+	if o := r.observer; o != nil {
+		defer observe(o.ObserveStopQuery, time.Now(), &err)
+	}
+
+	if r.readOnly.Load() {
+		return ErrReadOnly
+	}
+
+	unlock := r.nameLocks.lock(name)
+	defer unlock()
+
+	defer r.invalidateCache(name, true)
+
+	chunkKeys, err := r.queryChunkKeys(context.Background(), name)
+	if err != nil {
+		return fmt.Errorf("remove query: read query chunks: %w", err)
+	}
+	queryKeys := append(allQueryKeys(name), chunkKeys[name]...)
+
+	if r.pool.Mode() == fleet.RedisStandalone {
+		// remove the keys and the name from the active set in a single
+		// transaction.
+		conn := r.pool.Get()
+		defer conn.Close()
+
+		if err := conn.Send("MULTI"); err != nil {
+			return fmt.Errorf("remove query: %w", redisError(err))
+		}
+		if err := conn.Send("DEL", redigo.Args{}.AddFlat(queryKeys)...); err != nil {
+			return fmt.Errorf("remove query: del query keys: %w", redisError(err))
+		}
+		if err := conn.Send("SREM", activeQueriesKey, name); err != nil {
+			return fmt.Errorf("remove query: remove query name: %w", redisError(err))
+		}
+		if err := execTransaction(context.Background(), conn); err != nil {
+			return fmt.Errorf("remove query: %w", err)
+		}
+		return nil
+	}
+
 	// remove the sql and targeted hosts keys
-	if err := r.removeQueryInfo(name); err != nil {
+	if err := r.removeQueryInfo(queryKeys); err != nil {
 		return fmt.Errorf("remove query info: %w", err)
 	}
 
@@ -187,6 +684,123 @@ func (r *redisLiveQuery) StopQuery(name string) error {
 var cleanupExpiredQueriesModulo int64 = 10
 
 func (r *redisLiveQuery) QueriesForHost(hostID uint) (map[string]string, error) {
+	return r.QueriesForHostPlatform(hostID, "")
+}
+
+// QueriesForHostWithMeta returns the queries of QueriesForHost along with
+// their creation time and number of pending hosts, read in the same way as
+// QueryStatsBatch. A query that is stopped between the two reads is not
+// returned. Unlike QueriesForHost, it is not a check-in of the host: all the
+// queries that target the host are returned, whatever the maximum number of
+// queries per host, and they are not counted as dispatched nor observed.
+func (r *redisLiveQuery) QueriesForHostWithMeta(hostID uint) (map[string]fleet.LiveQueryInfo, error) {
+	ctx := context.Background()
+
+	byHost, err := r.collectQueriesForHosts(ctx, []hostQueryTarget{{id: hostID}})
+	if err != nil {
+		return nil, err
+	}
+	queries := byHost[hostID]
+	if len(queries) == 0 {
+		return map[string]fleet.LiveQueryInfo{}, nil
+	}
+
+	names := make([]string, 0, len(queries))
+	for name := range queries {
+		names = append(names, name)
+	}
+	stats, err := r.QueryStatsBatch(ctx, names)
+	if err != nil {
+		return nil, fmt.Errorf("read query stats: %w", err)
+	}
+
+	infos := make(map[string]fleet.LiveQueryInfo, len(queries))
+	for name, sql := range queries {
+		s := stats[name]
+		if s == nil {
+			continue
+		}
+		infos[name] = fleet.LiveQueryInfo{
+			SQL:          sql,
+			CreatedAt:    s.CreatedAt,
+			PendingHosts: s.PendingHosts,
+		}
+	}
+	return infos, nil
+}
+
+// QueriesForHostPlatform is like QueriesForHost, but it also returns the
+// queries restricted to the platform of the host (see RunQueryForPlatforms).
+// If hostPlatform is empty, the queries restricted to some platforms are not
+// returned.
+func (r *redisLiveQuery) QueriesForHostPlatform(hostID uint, hostPlatform string) (_ map[string]string, err error) {
+	if o := r.observer; o != nil {
+		defer observe(o.ObserveQueriesForHost, time.Now(), &err)
+	}
+
+	queries, err := r.queriesForHosts(context.Background(), []hostQueryTarget{{id: hostID, platform: hostPlatform}})
+	if err != nil {
+		return nil, err
+	}
+	return queries[hostID], nil
+}
+
+// QueriesForHosts is like QueriesForHost, but for multiple hosts at once: the
+// targets of the active queries are checked for all the hosts with a single
+// pipeline per Redis node, instead of one per host. The returned map has an
+// entry for each host, which is empty if the host has no query to run.
+func (r *redisLiveQuery) QueriesForHosts(ctx context.Context, hostIDs []uint) (_ map[uint]map[string]string, err error) {
+	if o := r.observer; o != nil {
+		defer observe(o.ObserveQueriesForHost, time.Now(), &err)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	hosts := make([]hostQueryTarget, 0, len(hostIDs))
+	seen := make(map[uint]bool, len(hostIDs))
+	for _, id := range hostIDs {
+		if !seen[id] {
+			seen[id] = true
+			hosts = append(hosts, hostQueryTarget{id: id})
+		}
+	}
+	return r.queriesForHosts(ctx, hosts)
+}
+
+// hostQueryTarget is a host for which the queries to run are collected.
+type hostQueryTarget struct {
+	id       uint
+	platform string
+	// labels are the labels of the host if any of the active queries targets
+	// labels, see resolveHostLabels.
+	labels map[uint]bool
+}
+
+// queriesForHosts returns the queries to run for each of the hosts, which
+// must be unique, capped by the maximum number of queries per host. The
+// returned queries are counted as dispatched.
+func (r *redisLiveQuery) queriesForHosts(ctx context.Context, hosts []hostQueryTarget) (map[uint]map[string]string, error) {
+	queries, err := r.collectQueriesForHosts(ctx, hosts)
+	if err != nil {
+		return nil, err
+	}
+	for _, host := range hosts {
+		hostQueries := queries[host.id]
+		n := len(hostQueries)
+		hostQueries = r.hostCap.apply(host.id, hostQueries, r.cachedQueryMeta)
+		if len(hostQueries) < n {
+			level.Debug(r.logger).Log("msg", "live queries capped for host", "host_id", host.id, "queries", n, "max", r.hostCap.max)
+		}
+		r.recordDispatches(hostQueries)
+		queries[host.id] = hostQueries
+	}
+	return queries, nil
+}
+
+// collectQueriesForHosts returns all the active queries that target each of
+// the hosts, which must be unique, without capping nor counting them.
+func (r *redisLiveQuery) collectQueriesForHosts(ctx context.Context, hosts []hostQueryTarget) (map[uint]map[string]string, error) {
 	// Get keys for active queries
 	names, err := r.LoadActiveQueryNames()
 	if err != nil {
@@ -200,73 +814,269 @@ func (r *redisLiveQuery) QueriesForHost(hostID uint) (map[string]string, error)
 		keyNames = append(keyNames, tkey)
 	}
 
+	queries := make(map[uint]map[string]string, len(hosts))
+	for i := range hosts {
+		hosts[i].labels = r.resolveHostLabels(ctx, hosts[i].id, names)
+		queries[hosts[i].id] = make(map[string]string)
+	}
+
 	keysBySlot := redis.SplitKeysBySlot(r.pool, keyNames...)
-	queries := make(map[string]string)
 	for _, qkeys := range keysBySlot {
-		if err := r.collectBatchQueriesForHost(hostID, qkeys, queries); err != nil {
+		if err := r.collectBatchQueriesForHosts(ctx, hosts, qkeys, queries); err != nil {
 			return nil, err
 		}
 	}
-
 	return queries, nil
 }
 
-func (r *redisLiveQuery) collectBatchQueriesForHost(hostID uint, queryKeys []string, queriesByHost map[string]string) error {
+func (r *redisLiveQuery) collectBatchQueriesForHosts(ctx context.Context, hosts []hostQueryTarget, queryKeys []string, queriesByHost map[uint]map[string]string) error {
 	conn := redis.ReadOnlyConn(r.pool, r.pool.Get())
 	defer conn.Close()
 
-	if r.cacheIsExpired() {
-		if err := r.loadCache(); err != nil {
-			return fmt.Errorf("load cache: %w", err)
-		}
+	if err := r.loadCacheIfExpired(); err != nil {
+		return fmt.Errorf("load cache: %w", err)
 	}
+	version := r.cacheVersion()
 
-	// Pipeline redis calls to check for this host in the bitfield of the
-	// targets of the query.
+	// Pipeline redis calls to check for each host in the bitfield of the
+	// targets of the query. The queries that target labels are only checked if
+	// the host is a member of one of the labels.
+	modes := make(map[string]queryMeta, len(queryKeys))
 	for _, key := range queryKeys {
-		if err := conn.Send("GETBIT", key, hostID); err != nil {
-			return fmt.Errorf("getbit query targets: %w", err)
+		name := extractTargetKeyName(key)
+		mode, _ := r.queryMetaOf(name)
+		modes[name] = mode
+		for _, host := range hosts {
+			if mode.lazy {
+				if err := sendLazyMembership(conn, name, host.id); err != nil {
+					return err
+				}
+				continue
+			}
+			if len(mode.labels) > 0 {
+				if labelsMatch(mode.labels, host.labels) {
+					if err := sendLabelMembership(conn, name, host.id); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			bitKey, offset := r.hostBitKey(name, host.id)
+			if err := conn.Send("GETBIT", bitKey, offset); err != nil {
+				return fmt.Errorf("getbit query targets: %w", redisError(err))
+			}
 		}
 	}
 
 	// Flush calls to begin receiving results.
 	if err := conn.Flush(); err != nil {
-		return fmt.Errorf("flush pipeline: %w", err)
+		return fmt.Errorf("flush pipeline: %w", redisError(err))
 	}
 
-	// Receive target and SQL in order of pipelined calls.
+	// Receive target and SQL in order of pipelined calls. The hosts that are
+	// targeted by a query whose SQL is not cached are kept by query name.
+	var missing []string
+	missingHosts := make(map[string][]hostQueryTarget)
 	for _, key := range queryKeys {
 		name := extractTargetKeyName(key)
+		for _, host := range hosts {
+			var targeted bool
+			mode := modes[name]
+			if mode.lazy {
+				var err error
+				if targeted, err = receiveLazyMembership(ctx, conn, host.id); err != nil {
+					return err
+				}
+			} else if len(mode.labels) > 0 {
+				if labelsMatch(mode.labels, host.labels) {
+					var err error
+					if targeted, err = receiveLabelMembership(ctx, conn); err != nil {
+						return err
+					}
+				}
+			} else {
+				// the result of GETBIT will not fail if the key does not exist, it will
+				// just return 0, so it can't be used to detect if the livequery still
+				// exists.
+				bit, err := redigo.Int(receiveContext(ctx, conn))
+				if err != nil {
+					return fmt.Errorf("receive target: %w", redisError(err))
+				}
+				targeted = bit == 1
+			}
 
-		// the result of GETBIT will not fail if the key does not exist, it will
-		// just return 0, so it can't be used to detect if the livequery still
-		// exists.
-		targeted, err := redigo.Int(conn.Receive())
-		if err != nil {
-			return fmt.Errorf("receive target: %w", err)
+			if targeted {
+				if sql, found := r.getSQLByCampaignID(name); found {
+					if platformMatches(r.getPlatformsByCampaignID(name), host.platform) {
+						queriesByHost[host.id][name] = sql
+					}
+				} else {
+					if _, ok := missingHosts[name]; !ok {
+						missing = append(missing, name)
+					}
+					missingHosts[name] = append(missingHosts[name], host)
+				}
+			}
 		}
+	}
 
-		if targeted == 1 {
-			if sql, found := r.getSQLByCampaignID(name); found {
-				queriesByHost[name] = sql
-			} else {
-				level.Warn(r.logger).Log("msg", "live query not found in cache", "name", name)
+	if len(missing) == 0 {
+		return nil
+	}
+
+	// Read-through for the SQL and platforms of the queries that are not
+	// cached (e.g. the query was invalidated since the cache was loaded, or the
+	// cache is full). Those keys use the same key tag as the targets keys, so
+	// they are on the same node.
+	for _, name := range missing {
+		_, sqlKey := generateKeys(name)
+		if err := conn.Send("GET", sqlKey); err != nil {
+			return fmt.Errorf("get query sql: %w", redisError(err))
+		}
+		if err := conn.Send("GET", generatePlatformsKey(name)); err != nil {
+			return fmt.Errorf("get query platforms: %w", redisError(err))
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("flush pipeline: %w", redisError(err))
+	}
+	for _, name := range missing {
+		sql, sqlErr := redigo.String(receiveContext(ctx, conn))
+		platforms, err := receivePlatforms(conn)
+		if err != nil {
+			return err
+		}
+		if sqlErr != nil {
+			if sqlErr != redigo.ErrNil {
+				return fmt.Errorf("receive query sql: %w", redisError(sqlErr))
+			}
+			level.Warn(r.logger).Log("msg", "live query sql not found", "name", name)
+			continue
+		}
+		for _, host := range missingHosts[name] {
+			if platformMatches(platforms, host.platform) {
+				queriesByHost[host.id][name] = sql
 			}
 		}
+		r.setSQLByCampaignID(name, sql, platforms, version)
 	}
 	return nil
 }
 
+// receivePlatforms receives the result of a GET of the platforms key of a
+// query and returns the list of platforms, which is empty if the query is not
+// restricted to some platforms.
+func receivePlatforms(conn redigo.Conn) ([]string, error) {
+	s, err := redigo.String(conn.Receive())
+	if err != nil {
+		if err == redigo.ErrNil {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("receive query platforms: %w", redisError(err))
+	}
+	if s == "" {
+		return nil, nil
+	}
+	return strings.Split(s, ","), nil
+}
+
+// platformMatches returns true if a query restricted to the provided
+// platforms can be returned to a host of the provided platform.
+func platformMatches(platforms []string, hostPlatform string) bool {
+	if len(platforms) == 0 {
+		return true
+	}
+	if hostPlatform == "" {
+		return false
+	}
+	family := fleet.PlatformFromHost(hostPlatform)
+	for _, p := range platforms {
+		if p == hostPlatform || p == family {
+			return true
+		}
+	}
+	return false
+}
+
 func (r *redisLiveQuery) QueryCompletedByHost(name string, hostID uint) error {
+	return r.QueryCompletedByHostContext(context.Background(), name, hostID)
+}
+
+// QueryCompletedByHostContext is like QueryCompletedByHost, but the Redis
+// commands are bounded by ctx, and it returns ctx.Err() if ctx is done before
+// the completion is recorded.
+func (r *redisLiveQuery) QueryCompletedByHostContext(ctx context.Context, name string, hostID uint) (err error) {
+	if o := r.observer; o != nil {
+		defer observe(o.ObserveQueryCompletedByHost, time.Now(), &err)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	conn := redis.ConfigureDoer(r.pool, r.pool.Get())
 	defer conn.Close()
 
-	targetKey, _ := generateKeys(name)
+	mode, known := r.queryMetaOf(name)
+	if !known {
+		var err error
+		if mode, err = readQueryMeta(ctx, conn, name); err != nil {
+			return err
+		}
+	}
+	if mode.lazy || len(mode.labels) > 0 {
+		completed := r.lazyQueryCompleted
+		if !mode.lazy {
+			completed = r.labelQueryCompleted
+		}
+		recorded, err := completed(ctx, name, hostID)
+		if err != nil {
+			return err
+		}
+		if recorded {
+			r.counters.completed.Add(1)
+		}
+		r.completions.notify(name, hostID)
+		return nil
+	}
+
+	var recorded bool
+	if r.resettableCompletions {
+		if recorded, err = r.bitfieldQueryCompleted(ctx, name, hostID); err != nil {
+			return err
+		}
+	} else {
+		bitKey, offset := r.hostBitKey(name, hostID)
+
+		// With chunks, the chunk of this host does not exist if the host was not
+		// targeted, check the bit first so that SETBIT does not create it.
+		targeted := true
+		if r.chunkSize > 0 {
+			bit, err := redigo.Int(doContext(ctx, conn, "GETBIT", bitKey, offset))
+			if err != nil {
+				return fmt.Errorf("getbit query key: %w", redisError(err))
+			}
+			targeted = bit == 1
+		}
 
-	// Update the bitfield for this host.
-	if _, err := conn.Do("SETBIT", targetKey, hostID, 0); err != nil {
-		return fmt.Errorf("setbit query key: %w", err)
+		// Update the bitfield for this host.
+		if targeted {
+			prev, err := redigo.Int(doContext(ctx, conn, "SETBIT", bitKey, offset, 0))
+			if err != nil {
+				return fmt.Errorf("setbit query key: %w", redisError(err))
+			}
+			if prev == 1 {
+				recorded = true
+				if err := r.incrCompletedHosts(ctx, name); err != nil {
+					return err
+				}
+			}
+		}
 	}
+	if recorded {
+		r.counters.completed.Add(1)
+	}
+	r.completions.notify(name, hostID)
 
 	// NOTE(mna): we could remove the query here if all bits are now off, meaning
 	// that all hosts have completed this query, but the BITCOUNT command can be
@@ -277,46 +1087,257 @@ func (r *redisLiveQuery) QueryCompletedByHost(name string, hostID uint) error {
 	return nil
 }
 
-func (r *redisLiveQuery) storeQueryInfo(name, sql string, hostIDs []uint) error {
+// queryInfo is the information stored for a live query.
+type queryInfo struct {
+	name      string
+	sql       string
+	hostIDs   []uint
+	platforms []string
+	createdAt time.Time
+	// chunkSize is the number of bits of the chunks of the targets bitfield,
+	// 0 if it is stored in a single bitfield.
+	chunkSize uint
+	// staleKeys are the keys of a previous run of the query to delete.
+	staleKeys []string
+	// lazy is true if the targets are stored as ranges (see RunQueryLazy).
+	lazy bool
+	// labels are the IDs of the targeted labels, if the query targets labels
+	// instead of hosts (see RunQueryForLabels).
+	labels []uint
+	// labelHosts is the number of members of the targeted labels when the
+	// query was started, if the query targets labels.
+	labelHosts int
+	// replace is true if a running query with the same name may be
+	// overwritten (see ReplaceQuery).
+	replace bool
+	// ttl is the expiration of the query, the default expiration is used if
+	// it is <= 0.
+	ttl time.Duration
+	// priority is the priority of the query (see RunQueryWithPriority).
+	priority int
+}
+
+// targetedHosts returns the number of hosts targeted by the query.
+func (info queryInfo) targetedHosts() int {
+	if len(info.labels) > 0 {
+		return info.labelHosts
+	}
+	return len(info.hostIDs)
+}
+
+// storeQuery stores the query information and adds its name to the active
+// queries set. With standalone Redis, this is done in a single transaction. With
+// Redis Cluster the active queries set is not on the same node, so the query
+// information is stored first and the name is added to the set after that. If
+// that last step fails, RepairActiveQueries adds the name to the set.
+func (r *redisLiveQuery) storeQuery(ctx context.Context, info queryInfo) error {
+	if r.pool.Mode() == fleet.RedisStandalone {
+		return r.storeQueriesTx(ctx, info)
+	}
+
+	// store the sql and targeted hosts information
+	if err := r.storeQueryInfo(ctx, info); err != nil {
+		return fmt.Errorf("store query info: %w", err)
+	}
+
+	// store name (campaign id) into the active live queries set
+	if err := r.storeQueryNames(ctx, info.name); err != nil {
+		return fmt.Errorf("store query name: %w", err)
+	}
+	return nil
+}
+
+// storeQueriesTx stores the information of the queries and adds their names
+// to the active queries set in a single transaction. It can only be used with
+// standalone Redis.
+func (r *redisLiveQuery) storeQueriesTx(ctx context.Context, infos ...queryInfo) error {
 	conn := r.pool.Get()
 	defer conn.Close()
 
+	if err := conn.Send("MULTI"); err != nil {
+		return fmt.Errorf("store query: %w", redisError(err))
+	}
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if _, err := sendQueryInfo(conn, info); err != nil {
+			return fmt.Errorf("store query: %w", err)
+		}
+		names = append(names, info.name)
+	}
+	if err := conn.Send("SADD", redigo.Args{}.Add(activeQueriesKey).AddFlat(names)...); err != nil {
+		return fmt.Errorf("store query: store query name: %w", redisError(err))
+	}
+	if err := execTransaction(ctx, conn); err != nil {
+		return fmt.Errorf("store query: %w", err)
+	}
+	return nil
+}
+
+// execTransaction executes the transaction started with MULTI on conn and
+// returns the first error returned by its commands, if any.
+func execTransaction(ctx context.Context, conn redigo.Conn) error {
+	replies, err := redigo.Values(doContext(ctx, conn, "EXEC"))
+	if err != nil {
+		return fmt.Errorf("exec transaction: %w", redisError(err))
+	}
+	for _, reply := range replies {
+		if err, ok := reply.(redigo.Error); ok {
+			return fmt.Errorf("exec transaction: %w", redisError(err))
+		}
+	}
+	return nil
+}
+
+// storeQueryInfo stores the information of the queries in a single pipeline.
+// With Redis Cluster, the keys of all the queries must be in the same slot.
+func (r *redisLiveQuery) storeQueryInfo(ctx context.Context, infos ...queryInfo) error {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	var n int
+	for _, info := range infos {
+		m, err := sendQueryInfo(conn, info)
+		if err != nil {
+			return err
+		}
+		n += m
+	}
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("flush pipeline: %w", redisError(err))
+	}
+	// receive the replies of the pipelined commands
+	for i := 0; i < n; i++ {
+		if _, err := receiveContext(ctx, conn); err != nil {
+			return fmt.Errorf("receive store reply: %w", redisError(err))
+		}
+	}
+	return nil
+}
+
+// sendQueryInfo sends (without flushing) the commands to store the query
+// information. It returns the number of commands sent.
+func sendQueryInfo(conn redigo.Conn, info queryInfo) (int, error) {
 	// Map the targeted host IDs to a bitfield. Store targets in one key and SQL
 	// in another.
-	targetKey, sqlKey := generateKeys(name)
-	targets := mapBitfield(hostIDs)
+	targetKey, sqlKey := generateKeys(info.name)
+	exp := queryExpiration
+	if info.ttl > 0 {
+		exp = info.ttl
+	}
+	expMillis := max(exp.Milliseconds(), 1)
+	var n int
 
 	// Ensure to set SQL first or else we can end up in a weird state in which a
 	// client reads that the query exists but cannot look up the SQL.
-	err := conn.Send("SET", sqlKey, sql, "EX", queryExpiration.Seconds())
+	err := conn.Send("SET", sqlKey, info.sql, "PX", expMillis)
 	if err != nil {
-		return fmt.Errorf("set sql: %w", err)
+		return 0, fmt.Errorf("set sql: %w", redisError(err))
+	}
+	n++
+	platformsKey := generatePlatformsKey(info.name)
+	if len(info.platforms) > 0 {
+		err = conn.Send("SET", platformsKey, strings.Join(info.platforms, ","), "PX", expMillis)
+	} else {
+		// the query may have been restricted to some platforms in a previous run
+		err = conn.Send("DEL", platformsKey)
 	}
-	_, err = conn.Do("SET", targetKey, targets, "EX", queryExpiration.Seconds())
 	if err != nil {
-		return fmt.Errorf("set targets: %w", err)
+		return 0, fmt.Errorf("set platforms: %w", redisError(err))
 	}
-	return nil
+	n++
+
+	// the query may have been stored in another mode in a previous run, and
+	// the hosts that completed it in that run must receive it again
+	rangesKey, doneKey := generateLazyKeys(info.name)
+	staleKeys := append([]string{rangesKey, doneKey, generateCompletedKey(targetKey)}, info.staleKeys...)
+	if err := conn.Send("DEL", redigo.Args{}.AddFlat(staleKeys)...); err != nil {
+		return 0, fmt.Errorf("del previous targets: %w", redisError(err))
+	}
+	n++
+
+	// in chunked, lazy and labels modes, the target key stays empty but is still
+	// stored as it is used to detect the stored queries (see
+	// RepairActiveQueries).
+	targets := []byte{}
+	var chunks []targetChunk
+	switch {
+	case info.lazy:
+		m, err := sendLazyTargets(conn, info, expMillis)
+		if err != nil {
+			return 0, err
+		}
+		n += m
+	case len(info.labels) > 0:
+		m, err := sendLabelTargets(conn, info, expMillis)
+		if err != nil {
+			return 0, err
+		}
+		n += m
+	case info.chunkSize > 0:
+		chunks = mapBitfieldChunks(info.hostIDs, info.chunkSize)
+	default:
+		targets = mapBitfield(info.hostIDs)
+	}
+
+	// replace the metadata of a previous run, if any
+	metaKey := generateMetaKey(info.name)
+	if err := conn.Send("DEL", metaKey); err != nil {
+		return 0, fmt.Errorf("del metadata: %w", redisError(err))
+	}
+	metaArgs := redigo.Args{}.Add(metaKey, metaCreatedAt, info.createdAt.UnixNano(), metaTargeted, info.targetedHosts())
+	if len(chunks) > 0 {
+		metaArgs = metaArgs.Add(metaChunks, formatChunkIndexes(chunks))
+	}
+	if info.lazy {
+		metaArgs = metaArgs.Add(metaLazy, 1)
+	}
+	if len(info.labels) > 0 {
+		metaArgs = metaArgs.Add(metaLabels, formatLabelIDs(info.labels))
+	}
+	if info.priority != 0 {
+		metaArgs = metaArgs.Add(metaPriority, info.priority)
+	}
+	if err := conn.Send("HSET", metaArgs...); err != nil {
+		return 0, fmt.Errorf("set metadata: %w", redisError(err))
+	}
+	if err := conn.Send("PEXPIRE", metaKey, expMillis); err != nil {
+		return 0, fmt.Errorf("expire metadata: %w", redisError(err))
+	}
+	n += 3
+
+	// store the chunks before the target key, for the same reason as the SQL.
+	for _, chunk := range chunks {
+		if err := conn.Send("SET", generateChunkKey(info.name, chunk.idx), chunk.bits, "PX", expMillis); err != nil {
+			return 0, fmt.Errorf("set targets chunk: %w", redisError(err))
+		}
+		n++
+	}
+
+	err = conn.Send("SET", targetKey, targets, "PX", expMillis)
+	if err != nil {
+		return 0, fmt.Errorf("set targets: %w", redisError(err))
+	}
+	n++
+	return n, nil
 }
 
-func (r *redisLiveQuery) storeQueryNames(names ...string) error {
+func (r *redisLiveQuery) storeQueryNames(ctx context.Context, names ...string) error {
 	conn := redis.ConfigureDoer(r.pool, r.pool.Get())
 	defer conn.Close()
 
 	var args redigo.Args
 	args = args.Add(activeQueriesKey)
 	args = args.AddFlat(names)
-	_, err := conn.Do("SADD", args...)
-	return err
+	_, err := doContext(ctx, conn, "SADD", args...)
+	return redisError(err)
 }
 
-func (r *redisLiveQuery) removeQueryInfo(name string) error {
+func (r *redisLiveQuery) removeQueryInfo(queryKeys []string) error {
 	conn := redis.ConfigureDoer(r.pool, r.pool.Get())
 	defer conn.Close()
 
-	targetKey, sqlKey := generateKeys(name)
-	if _, err := conn.Do("DEL", targetKey, sqlKey); err != nil {
-		return fmt.Errorf("del query keys: %w", err)
+	if _, err := conn.Do("DEL", redigo.Args{}.AddFlat(queryKeys)...); err != nil {
+		return fmt.Errorf("del query keys: %w", redisError(err))
 	}
 	return nil
 }
@@ -329,7 +1350,7 @@ func (r *redisLiveQuery) removeQueryNames(names ...string) error {
 	args = args.Add(activeQueriesKey)
 	args = args.AddFlat(names)
 	_, err := conn.Do("SREM", args...)
-	return err
+	return redisError(err)
 }
 
 func (r *redisLiveQuery) LoadActiveQueryNames() ([]string, error) {
@@ -345,45 +1366,121 @@ func (r *redisLiveQuery) LoadActiveQueryNames() ([]string, error) {
 		return names
 	}
 
-	if !r.cacheIsExpired() {
-		return copyActiveQueries(), nil
-	}
-
-	if err := r.loadCache(); err != nil {
+	if err := r.loadCacheIfExpired(); err != nil {
 		return nil, fmt.Errorf("load cache: %w", err)
 	}
 
 	return copyActiveQueries(), nil
 }
 
+// loadCacheIfExpired reloads the cache if it is expired. The concurrent calls
+// wait for a single reload instead of all reloading the cache.
+func (r *redisLiveQuery) loadCacheIfExpired() error {
+	if !r.cacheIsExpired() {
+		return nil
+	}
+
+	r.cache.loadMu.Lock()
+	defer r.cache.loadMu.Unlock()
+	if !r.cacheIsExpired() {
+		return nil
+	}
+	return r.loadCache()
+}
+
 func (r *redisLiveQuery) loadCache() error {
+	ctx := context.Background()
 	expiredQueries := make(map[string]struct{})
 	sqlCache := make(map[string]string)
+	platformsCache := make(map[string][]string)
+	queryMetas := make(map[string]queryMeta)
+
+	// take a snapshot of the entries that can be reused, along with the
+	// version of the cache it corresponds to.
+	r.cache.mu.RLock()
+	version := r.cache.version
+	prevSQLCache := make(map[string]string, len(r.cache.sqlCache))
+	for id, sql := range r.cache.sqlCache {
+		prevSQLCache[id] = sql
+	}
+	prevPlatformsCache := make(map[string][]string, len(r.cache.platformsCache))
+	for id, platforms := range r.cache.platformsCache {
+		prevPlatformsCache[id] = platforms
+	}
+	prevQueryMetas := make(map[string]queryMeta, len(r.cache.queryMetas))
+	for id, meta := range r.cache.queryMetas {
+		prevQueryMetas[id] = meta
+	}
+	r.cache.mu.RUnlock()
+
 	conn := redis.ConfigureDoer(r.pool, r.pool.Get())
 	defer conn.Close()
 
 	activeIDs, err := redigo.Strings(conn.Do("SMEMBERS", activeQueriesKey))
 	if err != nil && err != redigo.ErrNil {
-		return fmt.Errorf("get active queries: %w", err)
+		return fmt.Errorf("get active queries: %w", redisError(err))
 	}
 
-	for _, id := range activeIDs {
-		_, sqlKey := generateKeys(id)
-
-		sql, err := redigo.String(conn.Do("GET", sqlKey))
-		if err != nil {
-			if err != redigo.ErrNil {
-				return fmt.Errorf("get query sql: %w", err)
+	// the entries of the previous cache are only reused if the query was not
+	// stopped or run again since they were cached, e.g. by another instance.
+	var unchanged map[string]bool
+	if len(prevSQLCache) > 0 {
+		cached := make([]string, 0, len(prevSQLCache))
+		for _, id := range activeIDs {
+			if _, ok := prevSQLCache[id]; ok {
+				cached = append(cached, id)
 			}
-
-			// It is possible the livequery key has expired but was still in the set
-			// - handle this gracefully by collecting the keys to remove them from
-			// the set and keep going.
+		}
+		var expired []string
+		unchanged, expired, err = r.revalidateCachedQueries(ctx, cached, prevQueryMetas)
+		if err != nil {
+			return fmt.Errorf("revalidate cached queries: %w", err)
+		}
+		for _, id := range expired {
 			expiredQueries[id] = struct{}{}
+		}
+	}
+
+	var fetchIDs []string
+	for _, id := range activeIDs {
+		if _, ok := expiredQueries[id]; ok {
+			continue
+		}
+		if sql, ok := prevSQLCache[id]; ok && unchanged[id] {
+			sqlCache[id] = sql
+			if platforms := prevPlatformsCache[id]; len(platforms) > 0 {
+				platformsCache[id] = platforms
+			}
+			queryMetas[id] = prevQueryMetas[id]
 			continue
 		}
+		fetchIDs = append(fetchIDs, id)
+	}
 
-		sqlCache[id] = sql
+	fetched, expired, err := r.fetchQueries(ctx, fetchIDs)
+	if err != nil {
+		return fmt.Errorf("fetch queries: %w", err)
+	}
+	// It is possible the livequery key has expired but was still in the set -
+	// handle this gracefully by collecting the keys to remove them from the
+	// set and keep going.
+	for _, id := range expired {
+		expiredQueries[id] = struct{}{}
+	}
+	for _, id := range fetchIDs {
+		q, ok := fetched[id]
+		if !ok {
+			continue
+		}
+		// the metadata is needed for all the queries, even when the cache is
+		// full
+		queryMetas[id] = q.meta
+		if len(sqlCache) < maxSQLCacheSize {
+			sqlCache[id] = q.sql
+			if len(q.platforms) > 0 {
+				platformsCache[id] = q.platforms
+			}
+		}
 	}
 
 	// remove expired queries from the names list
@@ -398,10 +1495,33 @@ func (r *redisLiveQuery) loadCache() error {
 	}
 
 	r.cache.mu.Lock()
+	// the entries invalidated while loading may have been read before they
+	// changed, so they are not cached and the metadata stored by the change
+	// is kept.
+	for id, v := range r.cache.invalidated {
+		if v <= version {
+			continue
+		}
+		delete(sqlCache, id)
+		delete(platformsCache, id)
+		if meta, ok := r.cache.queryMetas[id]; ok {
+			queryMetas[id] = meta
+		} else {
+			delete(queryMetas, id)
+		}
+	}
+	r.cache.invalidated = make(map[string]uint64)
+	activeChanged := !sameNames(r.cache.activeQueriesCache, activeIDs)
 	r.cache.sqlCache = sqlCache
+	r.cache.platformsCache = platformsCache
+	r.cache.queryMetas = queryMetas
 	r.cache.activeQueriesCache = activeIDs
 	r.cache.cacheExp = time.Now().Add(r.cacheExpiration)
 	r.cache.mu.Unlock()
+	if activeChanged {
+		r.hostCap.reset()
+	}
+	r.counters.orphans.Store(int64(len(expiredQueries)))
 
 	if len(expiredQueries) > 0 {
 		// a certain percentage of the time so that we don't overwhelm redis with a
@@ -425,7 +1545,243 @@ func (r *redisLiveQuery) loadCache() error {
 	return nil
 }
 
-func (r *redisLiveQuery) CleanupInactiveQueries(ctx context.Context, inactiveCampaignIDs []uint) error {
+// sameNames returns true if a and b hold the same names, in any order. The
+// names must be unique.
+func sameNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := make(map[string]bool, len(a))
+	for _, name := range a {
+		set[name] = true
+	}
+	for _, name := range b {
+		if !set[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// loadedQuery is a query read from Redis when the cache is reloaded.
+type loadedQuery struct {
+	sql       string
+	platforms []string
+	meta      queryMeta
+}
+
+// fetchQueries reads the SQL, platforms and metadata of the queries, with a
+// single pipeline per cluster slot. It returns the queries that were read,
+// and the queries that expired or were stopped.
+func (r *redisLiveQuery) fetchQueries(ctx context.Context, names []string) (queries map[string]loadedQuery, expired []string, err error) {
+	namesByKey := make(map[string]string, len(names))
+	sqlKeys := make([]string, 0, len(names))
+	for _, name := range names {
+		_, sqlKey := generateKeys(name)
+		namesByKey[sqlKey] = name
+		sqlKeys = append(sqlKeys, sqlKey)
+	}
+
+	queries = make(map[string]loadedQuery, len(names))
+	for _, keys := range redis.SplitKeysBySlot(r.pool, sqlKeys...) {
+		batch := make([]string, 0, len(keys))
+		for _, key := range keys {
+			batch = append(batch, namesByKey[key])
+		}
+		batchExpired, err := r.collectBatchQueries(ctx, batch, queries)
+		if err != nil {
+			return nil, nil, err
+		}
+		expired = append(expired, batchExpired...)
+	}
+	return queries, expired, nil
+}
+
+// collectBatchQueries adds the queries that were read to queries and returns
+// the queries that expired, see fetchQueries. The keys of the queries must all
+// be in the same cluster slot.
+func (r *redisLiveQuery) collectBatchQueries(ctx context.Context, names []string, queries map[string]loadedQuery) ([]string, error) {
+	conn := redis.ReadOnlyConn(r.pool, r.pool.Get())
+	defer conn.Close()
+
+	for _, name := range names {
+		_, sqlKey := generateKeys(name)
+		if err := conn.Send("GET", sqlKey); err != nil {
+			return nil, fmt.Errorf("get query sql: %w", redisError(err))
+		}
+		if err := conn.Send("HMGET", queryMetaArgs(name)...); err != nil {
+			return nil, fmt.Errorf("get query metadata: %w", redisError(err))
+		}
+		if err := conn.Send("GET", generatePlatformsKey(name)); err != nil {
+			return nil, fmt.Errorf("get query platforms: %w", redisError(err))
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, fmt.Errorf("flush pipeline: %w", redisError(err))
+	}
+
+	var expired []string
+	for _, name := range names {
+		sql, sqlErr := redigo.String(receiveContext(ctx, conn))
+		if sqlErr != nil && sqlErr != redigo.ErrNil {
+			return nil, fmt.Errorf("receive query sql: %w", redisError(sqlErr))
+		}
+		values, err := redigo.Strings(receiveContext(ctx, conn))
+		if err != nil {
+			return nil, fmt.Errorf("receive query metadata: %w", redisError(err))
+		}
+		platforms, err := receivePlatforms(conn)
+		if err != nil {
+			return nil, err
+		}
+		if sqlErr == redigo.ErrNil {
+			expired = append(expired, name)
+			continue
+		}
+
+		meta, err := parseQueryMeta(values)
+		if err != nil {
+			return nil, err
+		}
+		queries[name] = loadedQuery{sql: sql, platforms: platforms, meta: meta}
+	}
+	return expired, nil
+}
+
+// revalidateCachedQueries checks whether the cached queries are unchanged in
+// Redis, with a single pipeline per cluster slot. The creation time of a query
+// identifies its run, so a query that was run again (e.g. replaced by another
+// instance) has changed. It returns the unchanged queries, and the queries
+// that expired or were stopped.
+func (r *redisLiveQuery) revalidateCachedQueries(ctx context.Context, names []string, metas map[string]queryMeta) (unchanged map[string]bool, expired []string, err error) {
+	namesByKey := make(map[string]string, len(names))
+	metaKeys := make([]string, 0, len(names))
+	for _, name := range names {
+		metaKey := generateMetaKey(name)
+		namesByKey[metaKey] = name
+		metaKeys = append(metaKeys, metaKey)
+	}
+
+	unchanged = make(map[string]bool, len(names))
+	for _, keys := range redis.SplitKeysBySlot(r.pool, metaKeys...) {
+		batch := make([]string, 0, len(keys))
+		for _, key := range keys {
+			batch = append(batch, namesByKey[key])
+		}
+		batchExpired, err := r.collectBatchUnchangedQueries(ctx, batch, metas, unchanged)
+		if err != nil {
+			return nil, nil, err
+		}
+		expired = append(expired, batchExpired...)
+	}
+	return unchanged, expired, nil
+}
+
+// collectBatchUnchangedQueries adds the queries that are unchanged to
+// unchanged and returns the queries that expired, see revalidateCachedQueries.
+// The keys of the queries must all be in the same cluster slot.
+func (r *redisLiveQuery) collectBatchUnchangedQueries(ctx context.Context, names []string, metas map[string]queryMeta, unchanged map[string]bool) ([]string, error) {
+	conn := redis.ReadOnlyConn(r.pool, r.pool.Get())
+	defer conn.Close()
+
+	for _, name := range names {
+		_, sqlKey := generateKeys(name)
+		if err := conn.Send("EXISTS", sqlKey); err != nil {
+			return nil, fmt.Errorf("check query sql: %w", redisError(err))
+		}
+		if err := conn.Send("HGET", generateMetaKey(name), metaCreatedAt); err != nil {
+			return nil, fmt.Errorf("get query creation time: %w", redisError(err))
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, fmt.Errorf("flush pipeline: %w", redisError(err))
+	}
+
+	var expired []string
+	for _, name := range names {
+		exists, err := redigo.Bool(receiveContext(ctx, conn))
+		if err != nil {
+			return nil, fmt.Errorf("receive query sql: %w", redisError(err))
+		}
+		createdAt, err := redigo.String(receiveContext(ctx, conn))
+		if err != nil && err != redigo.ErrNil {
+			return nil, fmt.Errorf("receive query creation time: %w", redisError(err))
+		}
+		if !exists {
+			expired = append(expired, name)
+			continue
+		}
+
+		// the queries started by an older version of Fleet have no creation
+		// time, they are considered unchanged.
+		var cachedAt string
+		if t := metas[name].createdAt; !t.IsZero() {
+			cachedAt = strconv.FormatInt(t.UnixNano(), 10)
+		}
+		if createdAt == cachedAt {
+			unchanged[name] = true
+		}
+	}
+	return expired, nil
+}
+
+// this is a variable so it can be changed in tests
+var cleanupInactiveBatchSize = 1000
+
+func (r *redisLiveQuery) CleanupInactiveQueries(ctx context.Context, inactiveCampaignIDs []uint) (err error) {
+	if o := r.observer; o != nil {
+		defer observe(o.ObserveCleanupInactiveQueries, time.Now(), &err)
+	}
+
+	if r.readOnly.Load() {
+		return ErrReadOnly
+	}
+	if len(inactiveCampaignIDs) == 0 {
+		return nil
+	}
+
+	remaining, err := r.cleanupInactiveQueries(ctx, inactiveCampaignIDs)
+	if err != nil {
+		return err
+	}
+	if remaining > 0 {
+		level.Info(r.logger).Log("msg", "live queries cleanup stopped after max duration", "max_duration", r.cleanupMaxDuration, "remaining", remaining)
+	}
+	return nil
+}
+
+// CleanupInactiveQueriesDryRun returns the names of the queries that would be
+// removed if only the queries of activeCampaignIDs were kept, i.e. the names
+// of the active queries set that are not one of those IDs, in ascending order.
+// Nothing is removed. Unlike CleanupInactiveQueries, which receives the IDs of
+// the campaigns to remove, it receives the IDs of the campaigns to keep, so
+// that it reports the orphaned queries, e.g. the queries of the campaigns that
+// were deleted.
+func (r *redisLiveQuery) CleanupInactiveQueriesDryRun(ctx context.Context, activeCampaignIDs []uint) (removed []string, err error) {
+	names, err := r.readActiveQueryNames()
+	if err != nil {
+		return nil, ctxerr.Wrap(ctx, err, "read active queries")
+	}
+
+	keep := make(map[string]bool, len(activeCampaignIDs))
+	for _, id := range activeCampaignIDs {
+		keep[strconv.FormatUint(uint64(id), 10)] = true
+	}
+	for _, name := range names {
+		if !keep[name] {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(removed)
+	return removed, nil
+}
+
+// cleanupInactiveQueries cleans up the inactive queries in batches, and stops
+// once the cleanup max duration is exceeded. It returns the number of inactive
+// queries that are left to be cleaned up. As the queries are removed from the
+// active set batch by batch, they are not part of the active queries anymore
+// on the next run, so the next run resumes where this one stopped.
+func (r *redisLiveQuery) cleanupInactiveQueries(ctx context.Context, inactiveCampaignIDs []uint) (remaining int, err error) {
 	// the following logic is used to cleanup inactive queries:
 	// 	* the inactive campaign IDs are removed from the livequery:active set
 	//
@@ -433,30 +1789,53 @@ func (r *redisLiveQuery) CleanupInactiveQueries(ctx context.Context, inactiveCam
 	// rest is just best effort cleanup to save Redis memory space, but those
 	// keys would otherwise be ignored and without effect.
 	//
-	// * remove the livequery:<ID> and sql:livequery:<ID> for every inactive
-	// 	campaign ID.
+	// * remove the livequery:<ID>, sql:livequery:<ID>, platforms:livequery:<ID>
+	// 	and meta:livequery:<ID> for every inactive campaign ID, as well as its
+	// 	livequery:<ID>:<chunk> keys if the targets are stored in chunks.
+
+	start := time.Now()
+	for len(inactiveCampaignIDs) > 0 {
+		batch := inactiveCampaignIDs
+		if len(batch) > cleanupInactiveBatchSize {
+			batch = batch[:cleanupInactiveBatchSize]
+		}
+		inactiveCampaignIDs = inactiveCampaignIDs[len(batch):]
 
-	if len(inactiveCampaignIDs) == 0 {
-		return nil
-	}
+		if err := r.removeInactiveQueries(ctx, batch); err != nil {
+			return 0, err
+		}
 
-	if err := r.removeInactiveQueries(ctx, inactiveCampaignIDs); err != nil {
-		return err
-	}
+		names := make([]string, 0, len(batch))
+		for _, id := range batch {
+			names = append(names, strconv.FormatUint(uint64(id), 10))
+		}
+		if r.cleanupLogRemoved {
+			level.Info(r.logger).Log("msg", "removed inactive live queries", "names", strings.Join(names, ","))
+		}
+		chunkKeys, err := r.queryChunkKeys(ctx, names...)
+		if err != nil {
+			return 0, ctxerr.Wrap(ctx, err, "read inactive query chunks")
+		}
 
-	keysToDel := make([]string, 0, len(inactiveCampaignIDs)*2)
-	for _, id := range inactiveCampaignIDs {
-		targetKey, sqlKey := generateKeys(strconv.FormatUint(uint64(id), 10))
-		keysToDel = append(keysToDel, targetKey, sqlKey)
-	}
+		keysToDel := make([]string, 0, len(batch)*6)
+		for _, name := range names {
+			keysToDel = append(keysToDel, allQueryKeys(name)...)
+			keysToDel = append(keysToDel, chunkKeys[name]...)
+		}
 
-	keysBySlot := redis.SplitKeysBySlot(r.pool, keysToDel...)
-	for _, keys := range keysBySlot {
-		if err := r.removeBatchInactiveKeys(ctx, keys); err != nil {
-			return err
+		keysBySlot := redis.SplitKeysBySlot(r.pool, keysToDel...)
+		for _, keys := range keysBySlot {
+			if err := r.removeBatchInactiveKeys(ctx, keys); err != nil {
+				return 0, err
+			}
+		}
+
+		// always process at least one batch so that progress is made
+		if r.cleanupMaxDuration > 0 && time.Since(start) >= r.cleanupMaxDuration {
+			return len(inactiveCampaignIDs), nil
 		}
 	}
-	return nil
+	return 0, nil
 }
 
 func (r *redisLiveQuery) removeBatchInactiveKeys(ctx context.Context, keys []string) error {
@@ -465,7 +1844,7 @@ func (r *redisLiveQuery) removeBatchInactiveKeys(ctx context.Context, keys []str
 
 	args := redigo.Args{}.AddFlat(keys)
 	if _, err := conn.Do("DEL", args...); err != nil {
-		return ctxerr.Wrap(ctx, err, "remove batch of inactive keys")
+		return ctxerr.Wrap(ctx, redisError(err), "remove batch of inactive keys")
 	}
 	return nil
 }
@@ -476,7 +1855,7 @@ func (r *redisLiveQuery) removeInactiveQueries(ctx context.Context, inactiveCamp
 
 	args := redigo.Args{}.Add(activeQueriesKey).AddFlat(inactiveCampaignIDs)
 	if _, err := conn.Do("SREM", args...); err != nil {
-		return ctxerr.Wrap(ctx, err, "remove inactive campaign IDs")
+		return ctxerr.Wrap(ctx, redisError(err), "remove inactive campaign IDs")
 	}
 	return nil
 }
@@ -1,33 +1,1591 @@
 package live_query
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/fleetdm/fleet/v4/server/datastore/redis"
 	"github.com/fleetdm/fleet/v4/server/datastore/redis/redistest"
+	"github.com/fleetdm/fleet/v4/server/fleet"
+	"github.com/fleetdm/fleet/v4/server/mock"
 	"github.com/fleetdm/fleet/v4/server/test"
 	"github.com/go-kit/log"
+	redigo "github.com/gomodule/redigo/redis"
+	"github.com/hashicorp/go-multierror"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestRedisLiveQuery(t *testing.T) {
 	for _, f := range testFunctions {
 		t.Run(test.FunctionName(f), func(t *testing.T) {
-			t.Run("standalone", func(t *testing.T) {
-				store := setupRedisLiveQuery(t, false)
-				f(t, store)
+			runStandaloneAndCluster(t, func(t *testing.T, pool fleet.RedisPool) {
+				f(t, NewRedisLiveQuery(pool, log.NewNopLogger(), 0))
 			})
+		})
+	}
+}
+
+// runStandaloneAndCluster runs fn as the "standalone" and "cluster" subtests
+// of t, with a pool connected to a standalone Redis and to a Redis Cluster.
+func runStandaloneAndCluster(t *testing.T, fn func(t *testing.T, pool fleet.RedisPool)) {
+	t.Run("standalone", func(t *testing.T) {
+		fn(t, redistest.SetupRedis(t, "*livequery", false, true, true))
+	})
+
+	t.Run("cluster", func(t *testing.T) {
+		fn(t, redistest.SetupRedis(t, "*livequery", true, true, true))
+	})
+}
+
+func TestRedisLiveQuerySQLCache(t *testing.T) {
+	runStandaloneAndCluster(t, testLiveQuerySQLCache)
+}
+
+func testLiveQuerySQLCache(t *testing.T, pool fleet.RedisPool) {
+	// use a long cache expiration so that only invalidations can refresh it
+	store := NewRedisLiveQuery(pool, log.NewNopLogger(), time.Hour)
+
+	require.NoError(t, store.RunQuery("1", "SELECT 1", []uint{1}))
+	require.NoError(t, store.RunQuery("2", "SELECT 2", []uint{1, 2}))
+
+	queries, err := store.QueriesForHost(1)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"1": "SELECT 1", "2": "SELECT 2"}, queries)
+
+	// update the SQL of a query, it is visible immediately
+	require.NoError(t, store.ReplaceQuery(context.Background(), "2", "SELECT 22", []uint{1, 2}))
+	queries, err = store.QueriesForHost(2)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"2": "SELECT 22"}, queries)
+	sql, ok := store.getSQLByCampaignID("2")
+	require.True(t, ok)
+	require.Equal(t, "SELECT 22", sql)
+
+	// stop a query, it is not returned anymore
+	require.NoError(t, store.StopQuery("1"))
+	queries, err = store.QueriesForHost(1)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"2": "SELECT 22"}, queries)
+	_, ok = store.getSQLByCampaignID("1")
+	require.False(t, ok)
+
+	conn := redis.ConfigureDoer(pool, pool.Get())
+	defer conn.Close()
+
+	// an invalidation only affects its entry, the entries of the other
+	// queries are reused on the next reload: the SQL changed behind the back
+	// of the store is not read again.
+	require.NoError(t, store.RunQuery("3", "SELECT 3", []uint{1}))
+	store.cache.cacheExp = time.Time{}
+	require.NoError(t, store.loadCache())
+	require.Equal(t, map[string]string{"2": "SELECT 22", "3": "SELECT 3"}, store.cache.sqlCache)
+	_, sqlKey := generateKeys("2")
+	_, err = conn.Do("SET", sqlKey, "SELECT 2222")
+	require.NoError(t, err)
+	require.NoError(t, store.StopQuery("3"))
+	store.cache.cacheExp = time.Time{}
+	require.NoError(t, store.loadCache())
+	require.Equal(t, map[string]string{"2": "SELECT 22"}, store.cache.sqlCache)
+	_, err = conn.Do("SET", sqlKey, "SELECT 22")
+	require.NoError(t, err)
+
+	// an entry invalidated while the cache is reloaded is not written back,
+	// as it may have been read before it changed.
+	store.cache.invalidated["2"] = store.cache.version + 1
+	store.cache.cacheExp = time.Time{}
+	require.NoError(t, store.loadCache())
+	_, ok = store.getSQLByCampaignID("2")
+	require.False(t, ok)
+	require.Empty(t, store.cache.invalidated)
+
+	// the reused entries are revalidated, so a query replaced by another
+	// instance and a query that expired are seen on the next reload
+	require.NoError(t, store.RunQuery("3", "SELECT 3", []uint{1}))
+	store.cache.cacheExp = time.Time{}
+	require.NoError(t, store.loadCache())
+	require.Equal(t, map[string]string{"2": "SELECT 22", "3": "SELECT 3"}, store.cache.sqlCache)
+
+	other := NewRedisLiveQuery(pool, log.NewNopLogger(), time.Hour)
+	require.NoError(t, other.ReplaceQuery(context.Background(), "2", "SELECT 222", []uint{1, 2}))
+	_, sqlKey = generateKeys("3")
+	_, err = conn.Do("DEL", sqlKey)
+	require.NoError(t, err)
+
+	store.cache.cacheExp = time.Time{}
+	queries, err = store.QueriesForHost(1)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"2": "SELECT 222"}, queries)
+	require.Equal(t, []string{"2"}, store.cache.activeQueriesCache)
+	require.EqualValues(t, 1, store.counters.orphans.Load())
+}
+
+func TestRedisLiveQueryHotQueries(t *testing.T) {
+	runStandaloneAndCluster(t, testLiveQueryHotQueries)
+}
+
+func testLiveQueryHotQueries(t *testing.T, pool fleet.RedisPool) {
+	var buf bytes.Buffer
+	store := NewRedisLiveQuery(pool, log.NewLogfmtLogger(&buf), 0, WithHotQueriesReport(time.Hour, 2))
+
+	require.NoError(t, store.RunQuery("a", "SELECT 1", []uint{1, 2, 3}))
+	require.NoError(t, store.RunQuery("b", "SELECT 2", []uint{1}))
+	require.NoError(t, store.RunQuery("c", "SELECT 3", []uint{1, 2}))
+
+	// host 3 checks in more often than the others
+	for _, hostID := range []uint{1, 2, 3, 3, 3, 3, 3, 3} {
+		_, err := store.QueriesForHost(hostID)
+		require.NoError(t, err)
+	}
+	// the report is not due yet
+	require.Empty(t, buf.String())
+	require.Equal(t, []hotQuery{{"a", 8}, {"c", 2}}, topHotQueries(store.hotQueries.snapshot(false), 2))
+
+	// the report logs the top queries and resets the counts
+	store.reportHotQueries()
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	require.Contains(t, lines[0], "rank=1 name=a dispatches=8")
+	require.Contains(t, lines[1], "rank=2 name=c dispatches=2")
+	require.Empty(t, store.hotQueries.snapshot(false))
+
+	// the report is logged periodically by the background task
+	_, err := store.QueriesForHost(2)
+	require.NoError(t, err)
+	require.Len(t, store.hotQueries.snapshot(false), 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store.hotQueries.interval = 10 * time.Millisecond
+	store.Start(ctx)
+	require.Eventually(t, func() bool {
+		return len(store.hotQueries.snapshot(false)) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRedisLiveQueryCleanupMaxDuration(t *testing.T) {
+	runStandaloneAndCluster(t, testLiveQueryCleanupMaxDuration)
+}
+
+func testLiveQueryCleanupMaxDuration(t *testing.T, pool fleet.RedisPool) {
+	ctx := context.Background()
+
+	oldBatchSize := cleanupInactiveBatchSize
+	cleanupInactiveBatchSize = 2
+	t.Cleanup(func() { cleanupInactiveBatchSize = oldBatchSize })
+
+	// the max duration is exceeded as soon as the first batch is done
+	store := NewRedisLiveQuery(pool, log.NewNopLogger(), 0, WithCleanupMaxDuration(time.Nanosecond))
+	for i := 1; i <= 5; i++ {
+		require.NoError(t, store.RunQuery(fmt.Sprint(i), fmt.Sprintf("SELECT %d", i), []uint{1}))
+	}
+
+	remaining, err := store.cleanupInactiveQueries(ctx, []uint{1, 2, 3, 4, 5})
+	require.NoError(t, err)
+	require.Equal(t, 3, remaining)
+	names, err := store.LoadActiveQueryNames()
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"3", "4", "5"}, names)
+
+	// the next run only gets the queries that are still active, so it resumes
+	// where the previous one stopped.
+	remaining, err = store.cleanupInactiveQueries(ctx, []uint{3, 4, 5})
+	require.NoError(t, err)
+	require.Equal(t, 1, remaining)
+	names, err = store.LoadActiveQueryNames()
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"5"}, names)
+
+	// without a max duration, everything is cleaned up
+	store.cleanupMaxDuration = 0
+	remaining, err = store.cleanupInactiveQueries(ctx, []uint{5})
+	require.NoError(t, err)
+	require.Zero(t, remaining)
+	names, err = store.LoadActiveQueryNames()
+	require.NoError(t, err)
+	require.Empty(t, names)
+}
+
+func TestRedisLiveQueryCleanupLogRemoved(t *testing.T) {
+	runStandaloneAndCluster(t, testLiveQueryCleanupLogRemoved)
+}
+
+func testLiveQueryCleanupLogRemoved(t *testing.T, pool fleet.RedisPool) {
+	ctx := context.Background()
+
+	var buf bytes.Buffer
+	store := NewRedisLiveQuery(pool, log.NewLogfmtLogger(&buf), 0)
+	require.NoError(t, store.RunQuery("1", "SELECT 1", []uint{1}))
+	require.NoError(t, store.CleanupInactiveQueries(ctx, []uint{1}))
+	require.NotContains(t, buf.String(), "removed inactive live queries")
+
+	store = NewRedisLiveQuery(pool, log.NewLogfmtLogger(&buf), 0, WithCleanupLogRemoved(true))
+	for i := 1; i <= 3; i++ {
+		require.NoError(t, store.RunQuery(fmt.Sprint(i), fmt.Sprintf("SELECT %d", i), []uint{1}))
+	}
+	removed, err := store.CleanupInactiveQueriesDryRun(ctx, []uint{2})
+	require.NoError(t, err)
+	require.Equal(t, []string{"1", "3"}, removed)
+	require.Empty(t, buf.String())
+
+	require.NoError(t, store.CleanupInactiveQueries(ctx, []uint{1, 3}))
+	require.Contains(t, buf.String(), `msg="removed inactive live queries" names=1,3`)
+	names, err := store.LoadActiveQueryNames()
+	require.NoError(t, err)
+	require.Equal(t, []string{"2"}, names)
+}
+
+func TestRedisLiveQueryReadOnly(t *testing.T) {
+	runStandaloneAndCluster(t, testLiveQueryReadOnly)
+}
+
+func testLiveQueryReadOnly(t *testing.T, pool fleet.RedisPool) {
+	ctx := context.Background()
+	store := NewRedisLiveQuery(pool, log.NewNopLogger(), 0)
+
+	require.NoError(t, store.RunQuery("1", "SELECT 1", []uint{1, 2}))
+
+	store.SetReadOnly(true)
+
+	// mutations are rejected
+	require.ErrorIs(t, store.RunQuery("2", "SELECT 2", []uint{1}), ErrReadOnly)
+	require.ErrorIs(t, store.StopQuery("1"), ErrReadOnly)
+	require.ErrorIs(t, store.CleanupInactiveQueries(ctx, []uint{1}), ErrReadOnly)
+	_, _, err := store.RepairActiveQueries(ctx)
+	require.ErrorIs(t, err, ErrReadOnly)
+
+	// reads and completions still work
+	queries, err := store.QueriesForHost(1)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"1": "SELECT 1"}, queries)
+	names, err := store.LoadActiveQueryNames()
+	require.NoError(t, err)
+	require.Equal(t, []string{"1"}, names)
+	require.NoError(t, store.QueryCompletedByHost("1", 1))
+	queries, err = store.QueriesForHost(1)
+	require.NoError(t, err)
+	require.Empty(t, queries)
+
+	store.SetReadOnly(false)
+	require.NoError(t, store.StopQuery("1"))
+	queries, err = store.QueriesForHost(2)
+	require.NoError(t, err)
+	require.Empty(t, queries)
+}
+
+func TestRedisLiveQueryPlatforms(t *testing.T) {
+	runStandaloneAndCluster(t, testLiveQueryPlatforms)
+}
+
+func testLiveQueryPlatforms(t *testing.T, pool fleet.RedisPool) {
+	for _, cacheExp := range []time.Duration{0, time.Hour} {
+		t.Run(fmt.Sprint(cacheExp), func(t *testing.T) {
+			store := NewRedisLiveQuery(pool, log.NewNopLogger(), cacheExp)
+			t.Cleanup(func() {
+				for _, name := range []string{"all", "darwin", "linux"} {
+					require.NoError(t, store.StopQuery(name))
+				}
+			})
+
+			require.NoError(t, store.RunQuery("all", "SELECT 1", []uint{1, 2, 3}))
+			require.NoError(t, store.RunQueryForPlatforms("darwin", "SELECT 2", []uint{1, 2, 3}, []string{"darwin"}))
+			require.NoError(t, store.RunQueryForPlatforms("linux", "SELECT 3", []uint{1, 2, 3}, []string{"linux", "windows"}))
+
+			// load the cache before checking each host so that both the cached and
+			// read-through paths are exercised.
+			require.NoError(t, store.loadCache())
+
+			cases := []struct {
+				platform string
+				want     map[string]string
+			}{
+				{"darwin", map[string]string{"all": "SELECT 1", "darwin": "SELECT 2"}},
+				{"ubuntu", map[string]string{"all": "SELECT 1", "linux": "SELECT 3"}},
+				{"windows", map[string]string{"all": "SELECT 1", "linux": "SELECT 3"}},
+				{"chrome", map[string]string{"all": "SELECT 1"}},
+				{"", map[string]string{"all": "SELECT 1"}},
+			}
+			for _, c := range cases {
+				queries, err := store.QueriesForHostPlatform(1, c.platform)
+				require.NoError(t, err)
+				require.Equal(t, c.want, queries, c.platform)
+			}
+
+			queries, err := store.QueriesForHost(2)
+			require.NoError(t, err)
+			require.Equal(t, map[string]string{"all": "SELECT 1"}, queries)
+
+			// run the query again without platform restrictions
+			require.NoError(t, store.ReplaceQuery(context.Background(), "darwin", "SELECT 2", []uint{1, 2, 3}))
+			queries, err = store.QueriesForHostPlatform(3, "windows")
+			require.NoError(t, err)
+			require.Equal(t, map[string]string{"all": "SELECT 1", "darwin": "SELECT 2", "linux": "SELECT 3"}, queries)
+		})
+	}
+}
+
+func TestRedisLiveQueryMetricsSnapshot(t *testing.T) {
+	runStandaloneAndCluster(t, testLiveQueryMetricsSnapshot)
+}
+
+func testLiveQueryMetricsSnapshot(t *testing.T, pool fleet.RedisPool) {
+	ctx := context.Background()
+	store := NewRedisLiveQuery(pool, log.NewNopLogger(), 0)
+
+	m, err := store.MetricsSnapshot(ctx)
+	require.NoError(t, err)
+	require.Equal(t, &LiveQueryMetrics{}, m)
+
+	require.NoError(t, store.RunQuery("1", "SELECT 1", []uint{1, 2, 3}))
+	require.NoError(t, store.RunQuery("2", "SELECT 2", []uint{2, 3}))
+	require.NoError(t, store.QueryCompletedByHost("1", 1))
+	require.NoError(t, store.QueryCompletedByHost("2", 3))
+	require.NoError(t, store.QueryCompletedByHost("1", 3))
+	// the completions that are not recorded are not counted: host 1 already
+	// completed query 1, and it is not targeted by query 2
+	require.NoError(t, store.QueryCompletedByHost("1", 1))
+	require.NoError(t, store.QueryCompletedByHost("2", 1))
+
+	// simulate an expired query still in the active set, and make sure it is
+	// not removed from the set when detected.
+	oldModulo := cleanupExpiredQueriesModulo
+	cleanupExpiredQueriesModulo = math.MaxInt64
+	t.Cleanup(func() { cleanupExpiredQueriesModulo = oldModulo })
+	conn := pool.Get()
+	defer conn.Close()
+	_, err = conn.Do("SADD", activeQueriesKey, "3")
+	require.NoError(t, err)
+	_, err = store.QueriesForHost(2)
+	require.NoError(t, err)
+
+	m, err = store.MetricsSnapshot(ctx)
+	require.NoError(t, err)
+	require.Equal(t, &LiveQueryMetrics{
+		ActiveQueries:         3,
+		InstanceTargetedHosts: 5,
+		InstanceCompleted:     3,
+		OrphanEstimate:        1,
+	}, m)
+
+	require.NoError(t, store.StopQuery("1"))
+	m, err = store.MetricsSnapshot(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, m.ActiveQueries)
+
+	// same with resettable completions
+	resettable := NewRedisLiveQuery(pool, log.NewNopLogger(), 0, WithResettableCompletions(true))
+	require.NoError(t, resettable.RunQuery("4", "SELECT 4", []uint{1}))
+	require.NoError(t, resettable.QueryCompletedByHost("4", 1))
+	require.NoError(t, resettable.QueryCompletedByHost("4", 1))
+	require.NoError(t, resettable.QueryCompletedByHost("4", 2))
+	m, err = resettable.MetricsSnapshot(ctx)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, m.InstanceCompleted)
+
+	cancelCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = store.MetricsSnapshot(cancelCtx)
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+type recordingSink struct {
+	mu          sync.Mutex
+	completions []Completion
+}
+
+func (s *recordingSink) QueryCompleted(c Completion) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.completions = append(s.completions, c)
+}
+
+func TestRedisLiveQueryCompletionSink(t *testing.T) {
+	runStandaloneAndCluster(t, testLiveQueryCompletionSink)
+}
 
-			t.Run("cluster", func(t *testing.T) {
-				store := setupRedisLiveQuery(t, true)
-				f(t, store)
+func testLiveQueryCompletionSink(t *testing.T, pool fleet.RedisPool) {
+	sink := &recordingSink{}
+	store := NewRedisLiveQuery(pool, log.NewNopLogger(), 0, WithCompletionSink(sink, 10))
+	store.Start(context.Background())
+	t.Cleanup(func() { require.NoError(t, store.Close(context.Background())) })
+
+	require.NoError(t, store.RunQuery("1", "SELECT 1", []uint{1, 2, 3}))
+	require.NoError(t, store.QueryCompletedByHost("1", 2))
+	require.NoError(t, store.QueryCompletedByHost("1", 1))
+	require.NoError(t, store.QueryCompletedByHost("1", 3))
+
+	require.Eventually(t, func() bool {
+		sink.mu.Lock()
+		defer sink.mu.Unlock()
+		return len(sink.completions) == 3
+	}, time.Second, 10*time.Millisecond)
+
+	var hostIDs []uint
+	for _, c := range sink.completions {
+		require.Equal(t, "1", c.Name)
+		hostIDs = append(hostIDs, c.HostID)
+	}
+	require.Equal(t, []uint{2, 1, 3}, hostIDs)
+}
+
+func TestRedisLiveQueryMaxSQLLength(t *testing.T) {
+	runStandaloneAndCluster(t, testLiveQueryMaxSQLLength)
+}
+
+func testLiveQueryMaxSQLLength(t *testing.T, pool fleet.RedisPool) {
+	// default limit
+	store := NewRedisLiveQuery(pool, log.NewNopLogger(), 0)
+	require.NoError(t, store.RunQuery("1", strings.Repeat("a", defaultMaxSQLLength), []uint{1}))
+	err := store.RunQuery("2", strings.Repeat("a", defaultMaxSQLLength+1), []uint{1})
+	require.ErrorIs(t, err, ErrSQLTooLong)
+
+	// custom limit
+	store = NewRedisLiveQuery(pool, log.NewNopLogger(), 0, WithMaxSQLLength(10))
+	require.NoError(t, store.RunQuery("3", "SELECT 123", []uint{1}))
+	err = store.RunQuery("4", "SELECT 1234", []uint{1})
+	require.ErrorIs(t, err, ErrSQLTooLong)
+	require.ErrorIs(t, err, ErrQueryTooLarge)
+	require.Contains(t, err.Error(), "11 bytes")
+
+	// the limit applies to all the ways of running a query
+	ctx := context.Background()
+	require.NoError(t, store.RunQueryContext(ctx, "5", "SELECT 123", []uint{1}))
+	err = store.RunQueryContext(ctx, "6", "SELECT 1234", []uint{1})
+	require.ErrorIs(t, err, ErrQueryTooLarge)
+	err = store.RunQueryWithTTL(ctx, "7", "SELECT 1234", []uint{1}, time.Minute)
+	require.ErrorIs(t, err, ErrQueryTooLarge)
+	err = store.RunQueryForPlatforms("8", "SELECT 1234", []uint{1}, []string{"linux"})
+	require.ErrorIs(t, err, ErrQueryTooLarge)
+
+	// nothing is written for the rejected queries
+	conn := redis.ConfigureDoer(pool, pool.Get())
+	defer conn.Close()
+	for _, name := range []string{"4", "6", "7", "8"} {
+		n, err := redigo.Int(conn.Do("EXISTS", allQueryKeys(name)[0]))
+		require.NoError(t, err)
+		require.Zero(t, n, name)
+	}
+
+	names, err := store.LoadActiveQueryNames()
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"1", "3", "5"}, names)
+
+	// no limit
+	store = NewRedisLiveQuery(pool, log.NewNopLogger(), 0, WithMaxSQLLength(0))
+	require.NoError(t, store.RunQuery("9", strings.Repeat("a", defaultMaxSQLLength+1), []uint{1}))
+}
+
+func TestRedisLiveQueryMaxTargetedHosts(t *testing.T) {
+	runStandaloneAndCluster(t, testLiveQueryMaxTargetedHosts)
+}
+
+func testLiveQueryMaxTargetedHosts(t *testing.T, pool fleet.RedisPool) {
+	ctx := context.Background()
+	hostIDs := func(n int) []uint {
+		ids := make([]uint, n)
+		for i := range ids {
+			ids[i] = uint(i + 1)
+		}
+		return ids
+	}
+
+	// default limit
+	store := NewRedisLiveQuery(pool, log.NewNopLogger(), 0)
+	err := store.RunQuery("1", "SELECT 1", hostIDs(defaultMaxTargetedHosts+1))
+	require.ErrorIs(t, err, ErrTooManyTargets)
+
+	// custom limit
+	store = NewRedisLiveQuery(pool, log.NewNopLogger(), 0, WithMaxTargetedHosts(3))
+	require.NoError(t, store.RunQuery("2", "SELECT 2", hostIDs(3)))
+	err = store.RunQuery("3", "SELECT 3", hostIDs(4))
+	require.ErrorIs(t, err, ErrTooManyTargets)
+	require.Contains(t, err.Error(), "4 hosts")
+
+	err = store.RunQueries(ctx, []fleet.LiveQuerySpec{
+		{Name: "4", SQL: "SELECT 4", HostIDs: hostIDs(3)},
+		{Name: "5", SQL: "SELECT 5", HostIDs: hostIDs(4)},
+	})
+	var specErr *SpecError
+	require.ErrorAs(t, err, &specErr)
+	require.Equal(t, "5", specErr.Name)
+	require.ErrorIs(t, err, ErrTooManyTargets)
+
+	names, err := store.LoadActiveQueryNames()
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"2"}, names)
+
+	// no limit
+	store = NewRedisLiveQuery(pool, log.NewNopLogger(), 0, WithMaxTargetedHosts(0))
+	require.NoError(t, store.RunQuery("6", "SELECT 6", hostIDs(defaultMaxTargetedHosts+1)))
+}
+
+func TestRedisLiveQueryListQueriesDetailed(t *testing.T) {
+	runStandaloneAndCluster(t, testLiveQueryListQueriesDetailed)
+}
+
+func testLiveQueryListQueriesDetailed(t *testing.T, pool fleet.RedisPool) {
+	ctx := context.Background()
+	store := NewRedisLiveQuery(pool, log.NewNopLogger(), 0)
+
+	details, err := store.ListQueriesDetailed(ctx, SortByAge, 0)
+	require.NoError(t, err)
+	require.Empty(t, details)
+
+	// query 2 has a larger bitfield than query 1, query 3 a much larger SQL
+	require.NoError(t, store.RunQuery("1", "SELECT 1", []uint{1}))
+	require.NoError(t, store.RunQuery("2", "SELECT 2", []uint{1, 1_000}))
+	require.NoError(t, store.RunQuery("3", "SELECT 3 FROM abc WHERE "+strings.Repeat("1 AND ", 100)+"1", []uint{1}))
+
+	// make query 2 the oldest and query 1 the newest
+	conn := redis.ConfigureDoer(pool, pool.Get())
+	defer conn.Close()
+	now := time.Now()
+	for name, age := range map[string]time.Duration{"1": time.Minute, "2": time.Hour, "3": 10 * time.Minute} {
+		_, err := conn.Do("HSET", generateMetaKey(name), metaCreatedAt, now.Add(-age).UnixNano())
+		require.NoError(t, err)
+	}
+
+	queryNames := func(details []QueryDetails) []string {
+		var names []string
+		for _, d := range details {
+			names = append(names, d.Name)
+		}
+		return names
+	}
+
+	details, err = store.ListQueriesDetailed(ctx, SortByAge, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"2", "3", "1"}, queryNames(details))
+	require.GreaterOrEqual(t, details[0].Age, time.Hour)
+	require.Equal(t, now.Add(-time.Hour).UnixNano(), details[0].CreatedAt.UnixNano())
+
+	details, err = store.ListQueriesDetailed(ctx, SortBySize, 2)
+	require.NoError(t, err)
+	require.Equal(t, []string{"3", "2"}, queryNames(details))
+	require.Equal(t, keysMemoryUsage(t, pool, allQueryKeys("3")...), details[0].SizeBytes)
+	require.Equal(t, keysMemoryUsage(t, pool, allQueryKeys("2")...), details[1].SizeBytes)
+
+	// the completed hosts of lazy queries are counted
+	lazySize := func() int64 {
+		details, err := store.ListQueriesDetailed(ctx, SortBySize, 0)
+		require.NoError(t, err)
+		for _, d := range details {
+			if d.Name == "4" {
+				return d.SizeBytes
+			}
+		}
+		t.Fatal("query 4 not found")
+		return 0
+	}
+	require.NoError(t, store.RunQueryLazy("4", "SELECT 4", []uint{1, 2}))
+	before := lazySize()
+	require.NoError(t, store.QueryCompletedByHost("4", 1))
+	after := lazySize()
+	require.Greater(t, after, before)
+	require.Equal(t, keysMemoryUsage(t, pool, allQueryKeys("4")...), after)
+	require.NoError(t, store.StopQuery("4"))
+
+	require.NoError(t, store.StopQuery("3"))
+	details, err = store.ListQueriesDetailed(ctx, SortBySize, 2)
+	require.NoError(t, err)
+	require.Equal(t, []string{"2", "1"}, queryNames(details))
+
+	_, err = store.ListQueriesDetailed(ctx, "name", 0)
+	require.Error(t, err)
+}
+
+// keysMemoryUsage returns the memory used by the keys that exist.
+func keysMemoryUsage(t *testing.T, pool fleet.RedisPool, keys ...string) int64 {
+	conn := redis.ConfigureDoer(pool, pool.Get())
+	defer conn.Close()
+
+	var total int64
+	for _, key := range keys {
+		n, err := redigo.Int64(conn.Do("MEMORY", "USAGE", key))
+		if err != redigo.ErrNil {
+			require.NoError(t, err)
+		}
+		total += n
+	}
+	return total
+}
+
+func TestRedisLiveQueryBitfieldChunks(t *testing.T) {
+	for _, chunkSize := range []int{8, 64, 1024} {
+		t.Run(fmt.Sprint(chunkSize), func(t *testing.T) {
+			for _, f := range testFunctions {
+				// it stores a value of the wrong type in the single bitfield key
+				if test.FunctionName(f) == test.FunctionName(testLiveQueryRedisErrors) {
+					continue
+				}
+				t.Run(test.FunctionName(f), func(t *testing.T) {
+					runStandaloneAndCluster(t, func(t *testing.T, pool fleet.RedisPool) {
+						f(t, NewRedisLiveQuery(pool, log.NewNopLogger(), 0, WithBitfieldChunkSize(chunkSize)))
+					})
+				})
+			}
+
+			t.Run("chunks", func(t *testing.T) {
+				runStandaloneAndCluster(t, func(t *testing.T, pool fleet.RedisPool) {
+					testLiveQueryBitfieldChunks(t, pool, chunkSize)
+				})
+			})
+		})
+	}
+}
+
+func testLiveQueryBitfieldChunks(t *testing.T, pool fleet.RedisPool, chunkSize int) {
+	ctx := context.Background()
+	store := NewRedisLiveQuery(pool, log.NewNopLogger(), 0, WithBitfieldChunkSize(chunkSize))
+	conn := redis.ConfigureDoer(pool, pool.Get())
+	defer conn.Close()
+
+	chunkExists := func(name string, hostID uint) bool {
+		n, err := redigo.Int(conn.Do("EXISTS", generateChunkKey(name, hostID/uint(chunkSize))))
+		require.NoError(t, err)
+		return n == 1
+	}
+
+	hostIDs := []uint{1, uint(chunkSize) - 1, uint(chunkSize), 10_000}
+	require.NoError(t, store.RunQuery("1", "SELECT 1", hostIDs))
+	for _, id := range hostIDs {
+		require.True(t, chunkExists("1", id), id)
+		queries, err := store.QueriesForHost(id)
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{"1": "SELECT 1"}, queries, id)
+	}
+	// the chunks between the targeted hosts are not stored
+	require.False(t, chunkExists("1", 5_000))
+	queries, err := store.QueriesForHost(5_000)
+	require.NoError(t, err)
+	require.Empty(t, queries)
+
+	// completing the query for a host that is not targeted does not create its
+	// chunk
+	require.NoError(t, store.QueryCompletedByHost("1", 5_000))
+	require.False(t, chunkExists("1", 5_000))
+	require.NoError(t, store.QueryCompletedByHost("1", 10_000))
+	queries, err = store.QueriesForHost(10_000)
+	require.NoError(t, err)
+	require.Empty(t, queries)
+
+	// the pending hosts are in ascending order even if the chunks are not listed
+	// in ascending order in the metadata
+	chunks, err := redigo.String(conn.Do("HGET", generateMetaKey("1"), metaChunks))
+	require.NoError(t, err)
+	idxs := strings.Split(chunks, ",")
+	for i, j := 0, len(idxs)-1; i < j; i, j = i+1, j-1 {
+		idxs[i], idxs[j] = idxs[j], idxs[i]
+	}
+	_, err = conn.Do("HSET", generateMetaKey("1"), metaChunks, strings.Join(idxs, ","))
+	require.NoError(t, err)
+	pending, err := store.PendingHostsForQuery(ctx, "1")
+	require.NoError(t, err)
+	require.Equal(t, hostIDs[:3], pending)
+
+	details, err := store.ListQueriesDetailed(ctx, SortBySize, 0)
+	require.NoError(t, err)
+	require.Len(t, details, 1)
+	chunkKeys, err := parseChunkKeys("1", strings.Join(idxs, ","))
+	require.NoError(t, err)
+	require.Len(t, chunkKeys, 3)
+	keys := allQueryKeys("1")
+	for _, k := range chunkKeys {
+		keys = append(keys, k, generateCompletedKey(k))
+	}
+	require.Equal(t, keysMemoryUsage(t, pool, keys...), details[0].SizeBytes)
+
+	// the chunks are counted even by an instance with another chunk size
+	other := NewRedisLiveQuery(pool, log.NewNopLogger(), 0, WithBitfieldChunkSize(2*chunkSize))
+	otherDetails, err := other.ListQueriesDetailed(ctx, SortBySize, 0)
+	require.NoError(t, err)
+	require.Len(t, otherDetails, 1)
+	require.Equal(t, details[0].SizeBytes, otherDetails[0].SizeBytes)
+
+	// running the query again removes the chunks of the previous run
+	require.NoError(t, store.ReplaceQuery(ctx, "1", "SELECT 1", []uint{1}))
+	require.True(t, chunkExists("1", 1))
+	require.False(t, chunkExists("1", 10_000))
+
+	// stopping and cleaning up the queries removes their chunks
+	require.NoError(t, store.StopQuery("1"))
+	require.False(t, chunkExists("1", 1))
+
+	require.NoError(t, store.RunQuery("2", "SELECT 2", []uint{10_000}))
+	require.True(t, chunkExists("2", 10_000))
+	require.NoError(t, store.CleanupInactiveQueries(ctx, []uint{2}))
+	require.False(t, chunkExists("2", 10_000))
+}
+
+func TestRedisLiveQueryStatsBatch(t *testing.T) {
+	for _, chunkSize := range []int{0, 64} {
+		t.Run(fmt.Sprint(chunkSize), func(t *testing.T) {
+			runStandaloneAndCluster(t, func(t *testing.T, pool fleet.RedisPool) {
+				testLiveQueryStatsBatch(t, pool, chunkSize)
 			})
 		})
 	}
 }
 
-func setupRedisLiveQuery(t *testing.T, cluster bool) *redisLiveQuery {
-	pool := redistest.SetupRedis(t, "*livequery", cluster, true, true)
-	return NewRedisLiveQuery(pool, log.NewNopLogger(), 0)
+func testLiveQueryStatsBatch(t *testing.T, pool fleet.RedisPool, chunkSize int) {
+	ctx := context.Background()
+	store := NewRedisLiveQuery(pool, log.NewNopLogger(), 0, WithBitfieldChunkSize(chunkSize))
+
+	require.NoError(t, store.RunQuery("1", "SELECT 1", []uint{1, 2, 3}))
+	require.NoError(t, store.RunQuery("2", "SELECT 2", []uint{1, 500}))
+	require.NoError(t, store.RunQuery("3", "SELECT 3", []uint{7}))
+	require.NoError(t, store.QueryCompletedByHost("1", 2))
+	require.NoError(t, store.QueryCompletedByHost("2", 500))
+	require.NoError(t, store.QueryCompletedByHost("2", 3)) // not targeted
+	require.NoError(t, store.StopQuery("3"))
+
+	names := []string{"1", "2", "3", "4", "1"}
+	stats, err := store.QueryStatsBatch(ctx, names)
+	require.NoError(t, err)
+	require.Len(t, stats, 2)
+
+	require.Equal(t, "1", stats["1"].Name)
+	require.EqualValues(t, 3, stats["1"].TargetedHosts)
+	require.EqualValues(t, 2, stats["1"].PendingHosts)
+	require.EqualValues(t, 1, stats["1"].CompletedHosts)
+	require.False(t, stats["1"].CreatedAt.IsZero())
+
+	require.EqualValues(t, 2, stats["2"].TargetedHosts)
+	require.EqualValues(t, 1, stats["2"].PendingHosts)
+	require.EqualValues(t, 1, stats["2"].CompletedHosts)
+
+	// the batch stats match the stats of each query
+	for _, name := range names {
+		s, err := store.QueryStats(ctx, name)
+		if stats[name] == nil {
+			require.ErrorIs(t, err, ErrQueryNotFound)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, stats[name], s)
+	}
+
+	stats, err = store.QueryStatsBatch(ctx, nil)
+	require.NoError(t, err)
+	require.Empty(t, stats)
+}
+
+func TestRedisLiveQueryLazy(t *testing.T) {
+	runStandaloneAndCluster(t, testLiveQueryLazy)
+}
+
+func testLiveQueryLazy(t *testing.T, pool fleet.RedisPool) {
+	ctx := context.Background()
+	store := NewRedisLiveQuery(pool, log.NewNopLogger(), 0)
+
+	// the same hosts are targeted by an eager and a lazy query
+	rnd := rand.New(rand.NewSource(1))
+	var hostIDs []uint
+	for id := uint(1); id < 500; id++ {
+		if rnd.Intn(3) > 0 {
+			hostIDs = append(hostIDs, id)
+		}
+	}
+	require.NoError(t, store.RunQuery("eager", "SELECT 1", hostIDs))
+	require.NoError(t, store.RunQueryLazy("lazy", "SELECT 1", hostIDs))
+
+	assertSameMembership := func() {
+		ids := make([]uint, 0, 510)
+		for id := uint(0); id < 510; id++ {
+			queries, err := store.QueriesForHost(id)
+			require.NoError(t, err)
+			_, eager := queries["eager"]
+			_, lazy := queries["lazy"]
+			require.Equal(t, eager, lazy, id)
+			ids = append(ids, id)
+		}
+
+		// the same is returned for all hosts at once
+		byHost, err := store.QueriesForHosts(ctx, ids)
+		require.NoError(t, err)
+		require.Len(t, byHost, len(ids))
+		for id, queries := range byHost {
+			_, eager := queries["eager"]
+			_, lazy := queries["lazy"]
+			require.Equal(t, eager, lazy, id)
+		}
+	}
+	assertSameMembership()
+
+	// complete the queries for some hosts, targeted or not
+	for id := uint(0); id < 510; id += 7 {
+		require.NoError(t, store.QueryCompletedByHost("eager", id))
+		require.NoError(t, store.QueryCompletedByHost("lazy", id))
+	}
+	assertSameMembership()
+
+	stats, err := store.QueryStatsBatch(ctx, []string{"eager", "lazy"})
+	require.NoError(t, err)
+	require.Equal(t, stats["eager"].PendingHosts, stats["lazy"].PendingHosts)
+	require.Equal(t, stats["eager"].CompletedHosts, stats["lazy"].CompletedHosts)
+	for _, name := range []string{"eager", "lazy"} {
+		total, completed, err := store.QueryCompletionStats(ctx, name)
+		require.NoError(t, err)
+		require.EqualValues(t, stats[name].TargetedHosts, total)
+		require.EqualValues(t, stats[name].CompletedHosts, completed)
+	}
+	eagerPending, err := store.PendingHostsForQuery(ctx, "eager")
+	require.NoError(t, err)
+	lazyPending, err := store.PendingHostsForQuery(ctx, "lazy")
+	require.NoError(t, err)
+	require.Len(t, lazyPending, int(stats["lazy"].PendingHosts))
+	require.Equal(t, eagerPending, lazyPending)
+
+	// another instance reads the mode from Redis
+	other := NewRedisLiveQuery(pool, log.NewNopLogger(), 0)
+	require.NoError(t, other.QueryCompletedByHost("lazy", hostIDs[0]))
+	queries, err := store.QueriesForHost(hostIDs[0])
+	require.NoError(t, err)
+	require.NotContains(t, queries, "lazy")
+
+	// resetting the host makes it receive the lazy query again, the
+	// completions of the eager query are not recorded so they are not reset
+	require.ErrorIs(t, other.ResetHostQueries(ctx, hostIDs[0]), ErrResetUnsupported)
+	queries, err = store.QueriesForHost(hostIDs[0])
+	require.NoError(t, err)
+	require.Contains(t, queries, "lazy")
+	require.Contains(t, queries, "eager")
+
+	// running the lazy query again in eager mode removes its ranges
+	require.NoError(t, store.ReplaceQuery(ctx, "lazy", "SELECT 2", []uint{1}))
+	rangesKey, doneKey := generateLazyKeys("lazy")
+	conn := redis.ConfigureDoer(pool, pool.Get())
+	defer conn.Close()
+	n, err := redigo.Int(conn.Do("EXISTS", rangesKey, doneKey))
+	require.NoError(t, err)
+	require.Zero(t, n)
+	queries, err = store.QueriesForHost(1)
+	require.NoError(t, err)
+	require.Equal(t, "SELECT 2", queries["lazy"])
+
+	// stopping a lazy query removes its keys
+	require.NoError(t, store.StopQuery("lazy"))
+	require.NoError(t, store.RunQueryLazy("lazy", "SELECT 3", []uint{1}))
+	require.NoError(t, store.StopQuery("lazy"))
+	require.NoError(t, store.QueryCompletedByHost("lazy", 1))
+	n, err = redigo.Int(conn.Do("EXISTS", rangesKey, doneKey))
+	require.NoError(t, err)
+	require.Zero(t, n)
+}
+
+func TestRedisLiveQueryClockSkew(t *testing.T) {
+	runStandaloneAndCluster(t, testLiveQueryClockSkew)
+}
+
+func testLiveQueryClockSkew(t *testing.T, pool fleet.RedisPool) {
+	ctx := context.Background()
+	now := time.Now()
+
+	// the clock of this Fleet server is one hour ahead
+	ahead := NewRedisLiveQuery(pool, log.NewNopLogger(), 0)
+	ahead.clock = func() time.Time { return now.Add(time.Hour) }
+	store := NewRedisLiveQuery(pool, log.NewNopLogger(), 0)
+	store.clock = func() time.Time { return now }
+
+	require.NoError(t, ahead.RunQuery("1", "SELECT 1", []uint{1}))
+	require.NoError(t, store.RunQuery("2", "SELECT 2", []uint{1}))
+
+	// the query started in the future has an age of 0, not a negative one
+	details, err := store.ListQueriesDetailed(ctx, SortByAge, 0)
+	require.NoError(t, err)
+	require.Len(t, details, 2)
+	for _, d := range details {
+		require.Zero(t, d.Age, d.Name)
+	}
+	require.Equal(t, "1", details[0].Name)
+	require.Equal(t, now.Add(time.Hour).UnixNano(), details[0].CreatedAt.UnixNano())
+
+	// the ages are computed with the clock of the server that reads them
+	details, err = ahead.ListQueriesDetailed(ctx, SortByAge, 0)
+	require.NoError(t, err)
+	require.Equal(t, "2", details[0].Name)
+	require.Equal(t, time.Hour, details[0].Age)
+	require.Zero(t, details[1].Age)
+
+	// the queries are not expired by the skew
+	queries, err := store.QueriesForHost(1)
+	require.NoError(t, err)
+	require.Len(t, queries, 2)
+}
+
+func TestRedisLiveQueryMemoryHighWaterMark(t *testing.T) {
+	runStandaloneAndCluster(t, testLiveQueryMemoryHighWaterMark)
+}
+
+func testLiveQueryMemoryHighWaterMark(t *testing.T, pool fleet.RedisPool) {
+	store := NewRedisLiveQuery(pool, log.NewNopLogger(), 0, WithMemoryHighWaterMark(1<<30, 0))
+	require.NoError(t, store.RunQuery("1", "SELECT 1", []uint{1, 2}))
+
+	// Redis reports a high memory usage
+	store.memory.read = func() (uint64, error) { return 2 << 30, nil }
+	err := store.RunQuery("2", "SELECT 2", []uint{1})
+	require.ErrorIs(t, err, ErrStoreMemoryExceeded)
+
+	// reads and completions still work
+	queries, err := store.QueriesForHost(1)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"1": "SELECT 1"}, queries)
+	require.NoError(t, store.QueryCompletedByHost("1", 1))
+	queries, err = store.QueriesForHost(1)
+	require.NoError(t, err)
+	require.Empty(t, queries)
+	require.NoError(t, store.StopQuery("1"))
+
+	// the memory usage is read from Redis
+	store.memory.read = store.readMemoryUsage
+	used, err := store.readMemoryUsage()
+	require.NoError(t, err)
+	require.NotZero(t, used)
+	require.NoError(t, store.RunQuery("2", "SELECT 2", []uint{1}))
+}
+
+// fakeObserver records the errors observed by operation.
+type fakeObserver struct {
+	mu   sync.Mutex
+	errs map[string][]error
+}
+
+func (o *fakeObserver) record(op string, dur time.Duration, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if dur < 0 {
+		panic("negative duration observed for " + op)
+	}
+	if o.errs == nil {
+		o.errs = make(map[string][]error)
+	}
+	o.errs[op] = append(o.errs[op], err)
+}
+
+func (o *fakeObserver) ObserveRunQuery(dur time.Duration, err error) {
+	o.record("run", dur, err)
+}
+
+func (o *fakeObserver) ObserveStopQuery(dur time.Duration, err error) {
+	o.record("stop", dur, err)
+}
+
+func (o *fakeObserver) ObserveQueriesForHost(dur time.Duration, err error) {
+	o.record("queries", dur, err)
+}
+
+func (o *fakeObserver) ObserveQueryCompletedByHost(dur time.Duration, err error) {
+	o.record("completed", dur, err)
+}
+
+func (o *fakeObserver) ObserveCleanupInactiveQueries(dur time.Duration, err error) {
+	o.record("cleanup", dur, err)
+}
+
+// take returns and resets the errors observed for op.
+func (o *fakeObserver) take(op string) []error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	errs := o.errs[op]
+	delete(o.errs, op)
+	return errs
+}
+
+func TestRedisLiveQueryObserver(t *testing.T) {
+	runStandaloneAndCluster(t, testLiveQueryObserver)
+}
+
+func testLiveQueryObserver(t *testing.T, pool fleet.RedisPool) {
+	ctx := context.Background()
+	obs := &fakeObserver{}
+	store := NewRedisLiveQuery(pool, log.NewNopLogger(), 0, WithObserver(obs))
+
+	// successful operations
+	require.NoError(t, store.RunQuery("1", "SELECT 1", []uint{1}))
+	require.NoError(t, store.RunQueries(ctx, []fleet.LiveQuerySpec{{Name: "2", SQL: "SELECT 2", HostIDs: []uint{1}}}))
+	_, err := store.QueriesForHost(1)
+	require.NoError(t, err)
+	require.NoError(t, store.QueryCompletedByHost("1", 1))
+	require.NoError(t, store.StopQuery("1"))
+	require.NoError(t, store.StopQueries(ctx, []string{"2"}))
+	require.NoError(t, store.CleanupInactiveQueries(ctx, []uint{3}))
+
+	require.Equal(t, []error{nil, nil}, obs.take("run"))
+	require.Equal(t, []error{nil}, obs.take("queries"))
+	require.Equal(t, []error{nil}, obs.take("completed"))
+	require.Equal(t, []error{nil, nil}, obs.take("stop"))
+	require.Equal(t, []error{nil}, obs.take("cleanup"))
+
+	// failed operations
+	err = store.RunQuery("1", "SELECT 1", nil)
+	require.Error(t, err)
+	require.Equal(t, []error{err}, obs.take("run"))
+
+	conn := redis.ConfigureDoer(pool, pool.Get())
+	defer conn.Close()
+	targetKey, _ := generateKeys("test")
+	_, err = conn.Do("SADD", targetKey, "1")
+	require.NoError(t, err)
+	err = store.QueryCompletedByHost("test", 1)
+	require.Error(t, err)
+	require.Equal(t, []error{err}, obs.take("completed"))
+
+	_, err = conn.Do("SET", activeQueriesKey, "1")
+	require.NoError(t, err)
+	_, err = store.QueriesForHost(1)
+	require.Error(t, err)
+	require.Equal(t, []error{err}, obs.take("queries"))
+
+	store.SetReadOnly(true)
+	require.ErrorIs(t, store.StopQuery("1"), ErrReadOnly)
+	require.ErrorIs(t, store.CleanupInactiveQueries(ctx, []uint{1}), ErrReadOnly)
+	require.Equal(t, []error{ErrReadOnly}, obs.take("stop"))
+	require.Equal(t, []error{ErrReadOnly}, obs.take("cleanup"))
+}
+
+func TestRedisLiveQueryForLabels(t *testing.T) {
+	runStandaloneAndCluster(t, testLiveQueryForLabels)
+}
+
+func testLiveQueryForLabels(t *testing.T, pool fleet.RedisPool) {
+	ctx := context.Background()
+
+	// label memberships by host, updated by the test
+	var mu sync.Mutex
+	var resolves int
+	var resolveCtx context.Context
+	memberships := map[uint][]uint{1: {10}, 2: {20}, 3: {10, 30}}
+	resolver := func(ctx context.Context, hostID uint) ([]uint, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		resolves++
+		resolveCtx = ctx
+		if hostID == 99 {
+			return nil, errors.New("resolver failure")
+		}
+		return memberships[hostID], nil
+	}
+	setLabels := func(hostID uint, labelIDs ...uint) {
+		mu.Lock()
+		defer mu.Unlock()
+		memberships[hostID] = labelIDs
+	}
+
+	// a resolver is required
+	store := NewRedisLiveQuery(pool, log.NewNopLogger(), 0)
+	require.Error(t, store.RunQueryForLabels(ctx, "1", "SELECT 1", []uint{10}))
+
+	store = NewRedisLiveQuery(pool, log.NewNopLogger(), 0, WithLabelMembershipResolver(resolver))
+	require.Error(t, store.RunQueryForLabels(ctx, "1", "SELECT 1", nil))
+
+	// the resolver is not called if no query targets labels
+	require.NoError(t, store.RunQuery("hosts", "SELECT hosts", []uint{1, 2}))
+	queries, err := store.QueriesForHost(1)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"hosts": "SELECT hosts"}, queries)
+	require.Zero(t, resolves)
+
+	require.NoError(t, store.RunQueryForLabels(ctx, "labels", "SELECT labels", []uint{10, 20}))
+	for hostID, want := range map[uint]map[string]string{
+		1: {"hosts": "SELECT hosts", "labels": "SELECT labels"},
+		2: {"hosts": "SELECT hosts", "labels": "SELECT labels"},
+		3: {"labels": "SELECT labels"},
+		4: {},
+	} {
+		queries, err := store.QueriesForHost(hostID)
+		require.NoError(t, err)
+		require.Equal(t, want, queries, hostID)
+	}
+
+	// host 4 joins a targeted label and host 2 leaves it after the query was
+	// started
+	setLabels(4, 20)
+	setLabels(2, 30)
+	queries, err = store.QueriesForHost(4)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"labels": "SELECT labels"}, queries)
+	queries, err = store.QueriesForHost(2)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"hosts": "SELECT hosts"}, queries)
+
+	// a host that completed the query does not receive it anymore, even if it
+	// is still a member of the label
+	require.NoError(t, store.QueryCompletedByHost("labels", 1))
+	require.NoError(t, store.QueryCompletedByHost("labels", 1))
+	queries, err = store.QueriesForHost(1)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"hosts": "SELECT hosts"}, queries)
+	_, completed, err := store.QueryCompletionStats(ctx, "labels")
+	require.NoError(t, err)
+	require.Equal(t, 1, completed)
+
+	// resetting the host makes it receive the query again, the completions of
+	// the query stored in a bitfield are not recorded so they are not reset
+	require.ErrorIs(t, store.ResetHostQueries(ctx, 1), ErrResetUnsupported)
+	queries, err = store.QueriesForHost(1)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"hosts": "SELECT hosts", "labels": "SELECT labels"}, queries)
+	_, completed, err = store.QueryCompletionStats(ctx, "labels")
+	require.NoError(t, err)
+	require.Zero(t, completed)
+	require.NoError(t, store.QueryCompletedByHost("labels", 1))
+
+	// the pending hosts are not known
+	_, err = store.PendingHostsForQuery(ctx, "labels")
+	require.Error(t, err)
+	require.NotErrorIs(t, err, ErrQueryNotFound)
+
+	// another instance reads the targeted labels from Redis
+	other := NewRedisLiveQuery(pool, log.NewNopLogger(), 0, WithLabelMembershipResolver(resolver))
+	require.NoError(t, other.QueryCompletedByHost("labels", 3))
+	queries, err = other.QueriesForHost(3)
+	require.NoError(t, err)
+	require.Empty(t, queries)
+	queries, err = other.QueriesForHost(4)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"labels": "SELECT labels"}, queries)
+
+	// the resolver receives the context of the call
+	type ctxKey struct{}
+	byHost, err := store.QueriesForHosts(context.WithValue(ctx, ctxKey{}, "check-in"), []uint{4})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"labels": "SELECT labels"}, byHost[4])
+	require.Equal(t, "check-in", resolveCtx.Value(ctxKey{}))
+
+	// the queries that target labels are skipped if the resolver fails
+	require.NoError(t, store.ReplaceQuery(ctx, "hosts", "SELECT hosts", []uint{99}))
+	queries, err = store.QueriesForHost(99)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"hosts": "SELECT hosts"}, queries)
+
+	// running the query again with host targets removes its labels
+	require.NoError(t, store.ReplaceQuery(ctx, "labels", "SELECT labels", []uint{2}))
+	queries, err = store.QueriesForHost(4)
+	require.NoError(t, err)
+	require.Empty(t, queries)
+	queries, err = store.QueriesForHost(2)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"labels": "SELECT labels"}, queries)
+
+	// stopping the query removes its keys, and a late completion does not
+	// create them again
+	require.NoError(t, store.StopQuery("labels"))
+	require.NoError(t, store.RunQueryForLabels(ctx, "labels", "SELECT labels", []uint{10}))
+	require.NoError(t, store.StopQuery("labels"))
+	require.NoError(t, store.QueryCompletedByHost("labels", 3))
+	conn := redis.ConfigureDoer(pool, pool.Get())
+	defer conn.Close()
+	_, doneKey := generateLazyKeys("labels")
+	n, err := redigo.Int(conn.Do("EXISTS", doneKey))
+	require.NoError(t, err)
+	require.Zero(t, n)
+}
+
+func TestRedisLiveQueryDatastoreLabels(t *testing.T) {
+	runStandaloneAndCluster(t, testLiveQueryDatastoreLabels)
+}
+
+func testLiveQueryDatastoreLabels(t *testing.T, pool fleet.RedisPool) {
+	ctx := context.Background()
+
+	ds := new(mock.Store)
+	ds.ListLabelsForHostFunc = func(ctx context.Context, hid uint) ([]*fleet.Label, error) {
+		if hid == 1 {
+			return []*fleet.Label{{ID: 10}, {ID: 30}}, nil
+		}
+		return []*fleet.Label{{ID: 30}}, nil
+	}
+	ds.CountHostsInTargetsFunc = func(ctx context.Context, filter fleet.TeamFilter, targets fleet.HostTargets, now time.Time) (fleet.TargetMetrics, error) {
+		require.NotNil(t, filter.User)
+		require.Equal(t, []uint{10, 20}, targets.LabelIDs)
+		return fleet.TargetMetrics{TotalHosts: 3}, nil
+	}
+	store := NewRedisLiveQuery(pool, log.NewNopLogger(), 0, WithDatastoreLabels(ds))
+
+	require.NoError(t, store.RunQueryForLabels(ctx, "labels", "SELECT labels", []uint{10, 20}))
+	require.True(t, ds.CountHostsInTargetsFuncInvoked)
+	total, completed, err := store.QueryCompletionStats(ctx, "labels")
+	require.NoError(t, err)
+	require.Equal(t, 3, total)
+	require.Zero(t, completed)
+
+	// the labels of the hosts are read from the datastore
+	queries, err := store.QueriesForHost(1)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"labels": "SELECT labels"}, queries)
+	queries, err = store.QueriesForHost(2)
+	require.NoError(t, err)
+	require.Empty(t, queries)
+	require.True(t, ds.ListLabelsForHostFuncInvoked)
+
+	require.NoError(t, store.QueryCompletedByHost("labels", 1))
+	stats, err := store.QueryStats(ctx, "labels")
+	require.NoError(t, err)
+	require.EqualValues(t, 3, stats.TargetedHosts)
+	require.EqualValues(t, 2, stats.PendingHosts)
+	require.EqualValues(t, 1, stats.CompletedHosts)
+
+	// a failure to count the members of the labels fails the query
+	ds.CountHostsInTargetsFunc = func(ctx context.Context, filter fleet.TeamFilter, targets fleet.HostTargets, now time.Time) (fleet.TargetMetrics, error) {
+		return fleet.TargetMetrics{}, errors.New("count failure")
+	}
+	require.ErrorContains(t, store.RunQueryForLabels(ctx, "other", "SELECT other", []uint{10}), "count failure")
+}
+
+func TestRedisLiveQueryMaxQueriesPerHostOldestFirst(t *testing.T) {
+	runStandaloneAndCluster(t, testLiveQueryMaxQueriesPerHostOldestFirst)
+}
+
+func testLiveQueryMaxQueriesPerHostOldestFirst(t *testing.T, pool fleet.RedisPool) {
+	opts := []Option{WithMaxQueriesPerHost(2), WithHostQueriesCapOrder(HostQueriesOldestFirst)}
+	store := NewRedisLiveQuery(pool, log.NewNopLogger(), 0, opts...)
+	now := time.Now()
+	store.clock = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+
+	// started from the last name to the first one, so that the oldest queries
+	// are not the first ones by name
+	for _, name := range []string{"5", "4", "3", "2", "1"} {
+		require.NoError(t, store.RunQuery(name, "SELECT "+name, []uint{1, 2}))
+	}
+
+	// the same 2 oldest queries are returned on each check-in
+	for i := 0; i < 3; i++ {
+		queries, err := store.QueriesForHost(1)
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{"5": "SELECT 5", "4": "SELECT 4"}, queries)
+	}
+
+	// the creation times are read from redis by another instance
+	other := NewRedisLiveQuery(pool, log.NewNopLogger(), 0, opts...)
+	queries, err := other.QueriesForHost(2)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"5": "SELECT 5", "4": "SELECT 4"}, queries)
+
+	// once completed, the next oldest query is returned
+	require.NoError(t, store.QueryCompletedByHost("5", 1))
+	queries, err = store.QueriesForHost(1)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"4": "SELECT 4", "3": "SELECT 3"}, queries)
+}
+
+func TestRedisLiveQueryQueriesForHostWithMetaUncapped(t *testing.T) {
+	runStandaloneAndCluster(t, testLiveQueryQueriesForHostWithMetaUncapped)
+}
+
+func testLiveQueryQueriesForHostWithMetaUncapped(t *testing.T, pool fleet.RedisPool) {
+	obs := &fakeObserver{}
+	store := NewRedisLiveQuery(pool, log.NewNopLogger(), 0,
+		WithMaxQueriesPerHost(2), WithHotQueriesReport(time.Hour, 10), WithObserver(obs))
+	for _, name := range []string{"1", "2", "3"} {
+		require.NoError(t, store.RunQuery(name, "SELECT "+name, []uint{1}))
+	}
+	obs.take("run")
+
+	// all the queries are returned, and it is not a check-in of the host
+	infos, err := store.QueriesForHostWithMeta(1)
+	require.NoError(t, err)
+	require.Len(t, infos, 3)
+	require.Empty(t, obs.take("queries"))
+	require.Empty(t, store.hotQueries.snapshot(false))
+
+	// the check-in is capped, counted and observed
+	queries, err := store.QueriesForHost(1)
+	require.NoError(t, err)
+	require.Len(t, queries, 2)
+	require.Len(t, obs.take("queries"), 1)
+	require.Len(t, store.hotQueries.snapshot(false), 2)
+}
+
+func TestRedisLiveQueryPriority(t *testing.T) {
+	runStandaloneAndCluster(t, testLiveQueryPriority)
+}
+
+func testLiveQueryPriority(t *testing.T, pool fleet.RedisPool) {
+	ctx := context.Background()
+	store := NewRedisLiveQuery(pool, log.NewNopLogger(), 0, WithMaxQueriesPerHost(2))
+
+	for _, name := range []string{"1", "2", "3"} {
+		require.NoError(t, store.RunQuery(name, "SELECT "+name, []uint{1, 2}))
+	}
+	require.NoError(t, store.RunQueryWithPriority(ctx, "urgent", "SELECT urgent", []uint{1, 2}, 10))
+
+	// the urgent query is returned on each check-in, while the others rotate
+	dispatched := make(map[string]int)
+	for i := 0; i < 3; i++ {
+		queries, err := store.QueriesForHost(1)
+		require.NoError(t, err)
+		require.Len(t, queries, 2)
+		require.Equal(t, "SELECT urgent", queries["urgent"])
+		for name := range queries {
+			dispatched[name]++
+		}
+	}
+	require.Equal(t, map[string]int{"1": 1, "2": 1, "3": 1, "urgent": 3}, dispatched)
+
+	// the rotation offsets are forgotten when the active queries change, e.g.
+	// on another instance
+	require.Equal(t, 1, trackedHosts(&store.hostCap))
+	another := NewRedisLiveQuery(pool, log.NewNopLogger(), 0)
+	require.NoError(t, another.RunQuery("4", "SELECT 4", []uint{3}))
+	names, err := store.LoadActiveQueryNames()
+	require.NoError(t, err)
+	require.Len(t, names, 5)
+	require.Zero(t, trackedHosts(&store.hostCap))
+	require.NoError(t, another.StopQuery("4"))
+
+	// the priority is read from redis by another instance, and it is kept
+	// even if the urgent query is the newest one
+	other := NewRedisLiveQuery(pool, log.NewNopLogger(), 0, WithMaxQueriesPerHost(1), WithHostQueriesCapOrder(HostQueriesOldestFirst))
+	queries, err := other.QueriesForHost(2)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"urgent": "SELECT urgent"}, queries)
+
+	// once completed, the other queries are returned
+	require.NoError(t, other.QueryCompletedByHost("urgent", 2))
+	queries, err = other.QueriesForHost(2)
+	require.NoError(t, err)
+	require.Len(t, queries, 1)
+	require.NotContains(t, queries, "urgent")
+}
+
+func TestRedisLiveQueryRunQueriesPartialFailure(t *testing.T) {
+	// with standalone Redis, the queries are stored in a single transaction, so
+	// they cannot partially fail.
+	pool := redistest.SetupRedis(t, "*livequery", true, true, false)
+	ctx := context.Background()
+	store := NewRedisLiveQuery(pool, log.NewNopLogger(), 0)
+
+	// nodeOf returns the ID of the cluster node that stores the key.
+	nodeOf := func(key string) string {
+		conn := pool.Get()
+		defer conn.Close()
+		require.NoError(t, redis.BindConn(pool, conn, key))
+		id, err := redigo.String(conn.Do("CLUSTER", "MYID"))
+		require.NoError(t, err)
+		return id
+	}
+
+	// pick a query stored on another node than the active queries set, and two
+	// queries stored on other nodes than that one.
+	activeNode := nodeOf(activeQueriesKey)
+	nodes := make(map[string]string)
+	var failing string
+	for i := 1; i <= 100; i++ {
+		name := fmt.Sprint(i)
+		targetKey, _ := generateKeys(name)
+		nodes[name] = nodeOf(targetKey)
+		if failing == "" && nodes[name] != activeNode {
+			failing = name
+		}
+	}
+	require.NotEmpty(t, failing)
+	var others []string
+	for i := 1; i <= 100 && len(others) < 2; i++ {
+		if name := fmt.Sprint(i); nodes[name] != nodes[failing] {
+			others = append(others, name)
+		}
+	}
+	require.Len(t, others, 2)
+
+	// the node of the failing query rejects the writes as if it was out of
+	// memory
+	conn := pool.Get()
+	targetKey, _ := generateKeys(failing)
+	require.NoError(t, redis.BindConn(pool, conn, targetKey))
+	maxMemory, err := redigo.Strings(conn.Do("CONFIG", "GET", "maxmemory"))
+	require.NoError(t, err)
+	policy, err := redigo.Strings(conn.Do("CONFIG", "GET", "maxmemory-policy"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		defer conn.Close()
+		_, err := conn.Do("CONFIG", "SET", "maxmemory", maxMemory[1])
+		require.NoError(t, err)
+		_, err = conn.Do("CONFIG", "SET", "maxmemory-policy", policy[1])
+		require.NoError(t, err)
+	})
+	_, err = conn.Do("CONFIG", "SET", "maxmemory-policy", "noeviction")
+	require.NoError(t, err)
+	_, err = conn.Do("CONFIG", "SET", "maxmemory", 1)
+	require.NoError(t, err)
+
+	// only the failing query is reported, the others are stored and served
+	err = store.RunQueries(ctx, []fleet.LiveQuerySpec{
+		{Name: others[0], SQL: "SELECT " + others[0], HostIDs: []uint{1}},
+		{Name: failing, SQL: "SELECT " + failing, HostIDs: []uint{1}},
+		{Name: others[1], SQL: "SELECT " + others[1], HostIDs: []uint{1}},
+	})
+	var merr *multierror.Error
+	require.ErrorAs(t, err, &merr)
+	require.Len(t, merr.Errors, 1)
+	var specErr *SpecError
+	require.ErrorAs(t, merr.Errors[0], &specErr)
+	require.Equal(t, failing, specErr.Name)
+	require.Contains(t, specErr.Error(), "OOM")
+
+	queries, err := store.QueriesForHost(1)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		others[0]: "SELECT " + others[0],
+		others[1]: "SELECT " + others[1],
+	}, queries)
+	names, err := store.LoadActiveQueryNames()
+	require.NoError(t, err)
+	require.ElementsMatch(t, others, names)
+}
+
+// countingPool wraps a standalone redis pool to count the commands sent to
+// Redis.
+type countingPool struct {
+	fleet.RedisPool
+	count atomic.Int64
+}
+
+func (p *countingPool) Get() redigo.Conn {
+	return countingConn{Conn: p.RedisPool.Get(), count: &p.count}
+}
+
+type countingConn struct {
+	redigo.Conn
+	count *atomic.Int64
+}
+
+func (c countingConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if cmd != "" {
+		c.count.Add(1)
+	}
+	return c.Conn.Do(cmd, args...)
+}
+
+func (c countingConn) Send(cmd string, args ...interface{}) error {
+	c.count.Add(1)
+	return c.Conn.Send(cmd, args...)
+}
+
+func BenchmarkRedisLiveQueryQueriesForHost(b *testing.B) {
+	const numQueries = 100
+
+	pool := &countingPool{RedisPool: redistest.SetupRedis(b, "*livequery", false, false, false)}
+	// expire the cache immediately so that each call reloads it, which is the
+	// worst case for the SQL cache.
+	store := NewRedisLiveQuery(pool, log.NewNopLogger(), 0)
+	for i := 0; i < numQueries; i++ {
+		require.NoError(b, store.RunQuery(fmt.Sprint(i), fmt.Sprintf("SELECT %d", i), []uint{1}))
+	}
+
+	pool.count.Store(0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		queries, err := store.QueriesForHost(1)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(queries) != numQueries {
+			b.Fatalf("want %d queries, got %d", numQueries, len(queries))
+		}
+	}
+	b.ReportMetric(float64(pool.count.Load())/float64(b.N), "redis-ops/op")
+}
+
+// BenchmarkRedisLiveQueryBitfieldChunks shows the memory and latency tradeoff
+// of the bitfield chunk size for sparse and high host IDs.
+func BenchmarkRedisLiveQueryBitfieldChunks(b *testing.B) {
+	const numQueries = 100
+
+	// a few hosts spread over a large range of IDs
+	hostIDs := make([]uint, 0, 100)
+	for id := uint(1); id < 1_000_000; id += 10_000 {
+		hostIDs = append(hostIDs, id)
+	}
+
+	for _, chunkSize := range []int{0, 1024, 8192, 65536} {
+		b.Run(fmt.Sprint(chunkSize), func(b *testing.B) {
+			pool := redistest.SetupRedis(b, "*livequery", false, false, false)
+			store := NewRedisLiveQuery(pool, log.NewNopLogger(), time.Hour, WithBitfieldChunkSize(chunkSize))
+			for i := 0; i < numQueries; i++ {
+				require.NoError(b, store.RunQuery(fmt.Sprint(i), fmt.Sprintf("SELECT %d", i), hostIDs))
+			}
+
+			details, err := store.ListQueriesDetailed(context.Background(), SortBySize, 0)
+			require.NoError(b, err)
+			var size int64
+			for _, d := range details {
+				size += d.SizeBytes
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				queries, err := store.QueriesForHost(hostIDs[i%len(hostIDs)])
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(queries) != numQueries {
+					b.Fatalf("want %d queries, got %d", numQueries, len(queries))
+				}
+			}
+			b.ReportMetric(float64(size), "redis-bytes")
+		})
+	}
+}
+
+// BenchmarkRedisLiveQueryLazy compares the write and read costs of the lazy
+// and eager modes for a campaign targeting a large list of hosts.
+func BenchmarkRedisLiveQueryLazy(b *testing.B) {
+	// 200K hosts with a gap every 1000 hosts
+	hostIDs := make([]uint, 0, 200_000)
+	for id := uint(100_000); len(hostIDs) < cap(hostIDs); id++ {
+		if id%1000 != 0 {
+			hostIDs = append(hostIDs, id)
+		}
+	}
+
+	for _, mode := range []string{"eager", "lazy"} {
+		pool := &countingPool{RedisPool: redistest.SetupRedis(b, "*livequery", false, false, false)}
+		store := NewRedisLiveQuery(pool, log.NewNopLogger(), time.Hour)
+		run := store.RunQuery
+		if mode == "lazy" {
+			run = store.RunQueryLazy
+		}
+
+		b.Run(mode+"/write", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := run("1", "SELECT 1", hostIDs); err != nil {
+					b.Fatal(err)
+				}
+				// the query must be stopped so that the next iteration does not
+				// fail with ErrQueryAlreadyRunning
+				b.StopTimer()
+				if err := store.StopQuery("1"); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+			}
+		})
+
+		if err := run("1", "SELECT 1", hostIDs); err != nil {
+			b.Fatal(err)
+		}
+		b.Run(mode+"/read", func(b *testing.B) {
+			pool.count.Store(0)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := store.QueriesForHost(hostIDs[i%len(hostIDs)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(pool.count.Load())/float64(b.N), "redis-ops/op")
+		})
+	}
 }
 
 func TestMapBitfield(t *testing.T) {
@@ -65,3 +1623,40 @@ func TestMapBitfield(t *testing.T) {
 		mapBitfield([]uint{79}),
 	)
 }
+
+func TestMapBitfieldChunks(t *testing.T) {
+	assert.Empty(t, mapBitfieldChunks(nil, 8))
+
+	assert.Equal(t, []targetChunk{{idx: 0, bits: []byte("\xc0")}}, mapBitfieldChunks([]uint{0, 1}, 8))
+	assert.Equal(t, []targetChunk{{idx: 0, bits: []byte("\x40")}}, mapBitfieldChunks([]uint{1}, 16))
+	assert.Equal(t, []targetChunk{{idx: 0, bits: []byte("\x00\x80")}}, mapBitfieldChunks([]uint{8}, 16))
+
+	// the empty chunks are not returned
+	assert.Equal(
+		t,
+		[]targetChunk{
+			{idx: 0, bits: []byte("\x40")},
+			{idx: 2, bits: []byte("\x80\x01")},
+			{idx: 12, bits: []byte("\x00\x20")},
+		},
+		mapBitfieldChunks([]uint{1, 64, 79, 394}, 32),
+	)
+
+	// the chunks combined are the same as the single bitfield
+	hostIDs := []uint{0, 1, 2, 3, 4, 5, 6, 7, 8, 113, 170}
+	var combined []byte
+	for _, c := range mapBitfieldChunks(hostIDs, 64) {
+		for len(combined) < int(c.idx)*8 {
+			combined = append(combined, 0)
+		}
+		combined = append(combined, c.bits...)
+	}
+	assert.Equal(t, mapBitfield(hostIDs), combined)
+}
+
+func TestMapHostRanges(t *testing.T) {
+	assert.Empty(t, mapHostRanges(nil))
+	assert.Equal(t, []hostRange{{1, 1}}, mapHostRanges([]uint{1}))
+	assert.Equal(t, []hostRange{{1, 3}}, mapHostRanges([]uint{1, 2, 3}))
+	assert.Equal(t, []hostRange{{1, 2}, {4, 4}, {6, 8}}, mapHostRanges([]uint{1, 2, 4, 6, 7, 7, 8}))
+}
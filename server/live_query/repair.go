@@ -0,0 +1,266 @@
+package live_query
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/fleetdm/fleet/v4/server/contexts/ctxerr"
+	"github.com/fleetdm/fleet/v4/server/datastore/redis"
+	"github.com/fleetdm/fleet/v4/server/fleet"
+	"github.com/go-kit/log/level"
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+// RepairActiveQueries reconciles the active queries set with the keys of the
+// queries stored in Redis: the queries that have their keys stored but are
+// missing from the set (e.g. the process crashed between storing the keys and
+// updating the set, which is not a single transaction with Redis Cluster) are
+// added to the set, and the names in the set that do not have a targets key
+// anymore are removed from it. It returns the names that were added and
+// removed. As it scans the whole keyspace, it is not part of
+// CleanupInactiveQueries and should be scheduled infrequently.
+func (r *redisLiveQuery) RepairActiveQueries(ctx context.Context) (added, removed []string, err error) {
+	if r.readOnly.Load() {
+		return nil, nil, ErrReadOnly
+	}
+
+	// the active set must be read before the keys are scanned: as the keys of a
+	// query are always stored before its name is added to the set and removed
+	// before its name is removed from the set, a name read from the set that has
+	// no key is guaranteed to be stale.
+	activeNames, err := r.readActiveQueryNames()
+	if err != nil {
+		return nil, nil, ctxerr.Wrap(ctx, err, "read active queries")
+	}
+	active := make(map[string]bool, len(activeNames))
+	for _, name := range activeNames {
+		active[name] = true
+	}
+
+	keys, err := redis.ScanKeys(r.pool, queryKeyPrefix+"{*}", 1000)
+	if err != nil {
+		return nil, nil, ctxerr.Wrap(ctx, redisError(err), "scan query keys")
+	}
+	stored := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		stored[extractTargetKeyName(key)] = true
+	}
+
+	var missing []string
+	for name := range stored {
+		if !active[name] {
+			missing = append(missing, name)
+		}
+	}
+	for _, name := range activeNames {
+		if !stored[name] {
+			removed = append(removed, name)
+		}
+	}
+
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		added, err = r.addStoredQueryNames(ctx, missing)
+		if err != nil {
+			return nil, nil, ctxerr.Wrap(ctx, err, "add missing active queries")
+		}
+	}
+	if len(removed) > 0 {
+		if err := r.removeQueryNames(removed...); err != nil {
+			return nil, nil, ctxerr.Wrap(ctx, err, "remove stale active queries")
+		}
+	}
+
+	if len(added) > 0 || len(removed) > 0 {
+		level.Info(r.logger).Log("msg", "repaired active live queries", "added", len(added), "removed", len(removed))
+	}
+	if r.cleanupLogRemoved && len(removed) > 0 {
+		level.Info(r.logger).Log("msg", "removed stale active live queries", "names", strings.Join(removed, ","))
+	}
+	return added, removed, nil
+}
+
+// addActiveIfStoredScript adds the name of a query (ARGV[1]) to the active
+// queries set (KEYS[2]) only if its SQL (KEYS[1]) is stored. It returns 1 if
+// the name was added. The keys are in different slots in Redis Cluster, so it
+// is only used in standalone mode.
+var addActiveIfStoredScript = redigo.NewScript(2, `
+if redis.call('EXISTS', KEYS[1]) == 0 then
+  return 0
+end
+return redis.call('SADD', KEYS[2], ARGV[1])
+`)
+
+// addStoredQueryNames adds the names of the queries that have their SQL
+// stored to the active queries set, and returns the names that were added. A
+// query that is stopped concurrently is not added back to the set: the check
+// and the addition are done by a script in standalone mode, and in Redis
+// Cluster the name is removed again if the SQL is gone once it is added, as
+// StopQuery removes the keys of a query before its name.
+func (r *redisLiveQuery) addStoredQueryNames(ctx context.Context, names []string) ([]string, error) {
+	unlock := r.nameLocks.lockAll(names)
+	defer unlock()
+
+	if r.pool.Mode() == fleet.RedisStandalone {
+		conn := r.pool.Get()
+		defer conn.Close()
+
+		for _, name := range names {
+			_, sqlKey := generateKeys(name)
+			if err := addActiveIfStoredScript.Send(conn, sqlKey, activeQueriesKey, name); err != nil {
+				return nil, fmt.Errorf("add stored query name: %w", redisError(err))
+			}
+		}
+		if err := conn.Flush(); err != nil {
+			return nil, fmt.Errorf("flush pipeline: %w", redisError(err))
+		}
+
+		var added []string
+		for _, name := range names {
+			ok, err := redigo.Bool(receiveContext(ctx, conn))
+			if err != nil {
+				return nil, fmt.Errorf("receive stored query name: %w", redisError(err))
+			}
+			if ok {
+				added = append(added, name)
+			}
+		}
+		return added, nil
+	}
+
+	var added []string
+	for _, name := range names {
+		ok, err := r.sqlExists(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("check query sql: %w", err)
+		}
+		if !ok {
+			continue
+		}
+		if err := r.storeQueryNames(ctx, name); err != nil {
+			return nil, fmt.Errorf("add stored query name: %w", err)
+		}
+		// the query may have been stopped after its SQL was checked, in which
+		// case its name was removed from the set before it was added.
+		ok, err = r.sqlExists(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("check query sql: %w", err)
+		}
+		if !ok {
+			if err := r.removeQueryNames(name); err != nil {
+				return nil, fmt.Errorf("remove stopped query name: %w", err)
+			}
+			continue
+		}
+		added = append(added, name)
+	}
+	return added, nil
+}
+
+// ActiveQueryNames returns the names of the queries that the store is
+// currently serving, in ascending order. Unlike LoadActiveQueryNames, it
+// bypasses the cache and excludes the names of the active queries set whose
+// query has expired. The names of the stored queries that are missing from the
+// set are not returned, see RepairActiveQueries.
+func (r *redisLiveQuery) ActiveQueryNames(ctx context.Context) ([]string, error) {
+	names, err := r.readActiveQueryNames()
+	if err != nil {
+		return nil, ctxerr.Wrap(ctx, err, "read active queries")
+	}
+
+	active, err := r.runningQueries(ctx, names)
+	if err != nil {
+		return nil, ctxerr.Wrap(ctx, err, "check active queries")
+	}
+	sort.Strings(active)
+	return active, nil
+}
+
+// QueryExists returns true if the query is currently active, without reading
+// its SQL. As for ActiveQueryNames, an expired query is not active.
+func (r *redisLiveQuery) QueryExists(ctx context.Context, name string) (bool, error) {
+	ok, err := r.sqlExists(ctx, name)
+	if err != nil {
+		return false, ctxerr.Wrap(ctx, err, "check query exists")
+	}
+	return ok, nil
+}
+
+// runningQueries returns the names of the queries that are running among
+// names.
+func (r *redisLiveQuery) runningQueries(ctx context.Context, names []string) ([]string, error) {
+	namesByKey := make(map[string]string, len(names))
+	sqlKeys := make([]string, 0, len(names))
+	for _, name := range names {
+		_, sqlKey := generateKeys(name)
+		namesByKey[sqlKey] = name
+		sqlKeys = append(sqlKeys, sqlKey)
+	}
+
+	var running []string
+	for _, keys := range redis.SplitKeysBySlot(r.pool, sqlKeys...) {
+		existing, err := r.collectBatchExistingKeys(ctx, keys)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range existing {
+			running = append(running, namesByKey[key])
+		}
+	}
+	return running, nil
+}
+
+// collectBatchExistingKeys returns the keys that exist among keys, which must
+// all be in the same cluster slot.
+func (r *redisLiveQuery) collectBatchExistingKeys(ctx context.Context, keys []string) ([]string, error) {
+	conn := redis.ReadOnlyConn(r.pool, r.pool.Get())
+	defer conn.Close()
+
+	for _, key := range keys {
+		if err := conn.Send("EXISTS", key); err != nil {
+			return nil, fmt.Errorf("check key: %w", redisError(err))
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, fmt.Errorf("flush pipeline: %w", redisError(err))
+	}
+
+	existing := make([]string, 0, len(keys))
+	for _, key := range keys {
+		ok, err := redigo.Bool(receiveContext(ctx, conn))
+		if err != nil {
+			return nil, fmt.Errorf("receive key exists: %w", redisError(err))
+		}
+		if ok {
+			existing = append(existing, key)
+		}
+	}
+	return existing, nil
+}
+
+// readActiveQueryNames reads the active queries set from Redis, bypassing
+// the cache.
+func (r *redisLiveQuery) readActiveQueryNames() ([]string, error) {
+	conn := redis.ConfigureDoer(r.pool, r.pool.Get())
+	defer conn.Close()
+
+	names, err := redigo.Strings(conn.Do("SMEMBERS", activeQueriesKey))
+	if err != nil && err != redigo.ErrNil {
+		return nil, fmt.Errorf("get active queries: %w", redisError(err))
+	}
+	return names, nil
+}
+
+func (r *redisLiveQuery) sqlExists(ctx context.Context, name string) (bool, error) {
+	conn := redis.ConfigureDoer(r.pool, r.pool.Get())
+	defer conn.Close()
+
+	_, sqlKey := generateKeys(name)
+	ok, err := redigo.Bool(doContext(ctx, conn, "EXISTS", sqlKey))
+	if err != nil {
+		return false, fmt.Errorf("exists query sql: %w", redisError(err))
+	}
+	return ok, nil
+}
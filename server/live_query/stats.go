@@ -0,0 +1,249 @@
+package live_query
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/fleetdm/fleet/v4/server/contexts/ctxerr"
+	"github.com/fleetdm/fleet/v4/server/datastore/redis"
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+// LiveQueryStats are the progress statistics of a live query.
+type LiveQueryStats struct {
+	Name string `json:"name"`
+	// TargetedHosts is the number of hosts targeted by the query, it is 0 if
+	// unknown (e.g. the query was started by an older version of Fleet). For
+	// a query that targets labels, it is the number of members of the labels
+	// when the query was started.
+	TargetedHosts int64 `json:"targeted_hosts"`
+	// PendingHosts is the number of targeted hosts that did not complete the
+	// query yet.
+	PendingHosts int64 `json:"pending_hosts"`
+	// CompletedHosts is the number of targeted hosts that completed the
+	// query, it is 0 if TargetedHosts is unknown.
+	CompletedHosts int64 `json:"completed_hosts"`
+	// CreatedAt is the time when the query was started, it is the zero time if
+	// unknown.
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// QueryStats returns the statistics of the live query. It returns an error
+// that wraps ErrQueryNotFound if the query does not exist.
+func (r *redisLiveQuery) QueryStats(ctx context.Context, name string) (*LiveQueryStats, error) {
+	stats, err := r.QueryStatsBatch(ctx, []string{name})
+	if err != nil {
+		return nil, err
+	}
+	if stats[name] == nil {
+		return nil, ctxerr.Wrap(ctx, ErrQueryNotFound, "query stats")
+	}
+	return stats[name], nil
+}
+
+// incrCompletedScript increments the completed hosts counter of a query only
+// if its metadata exists, so that a query that was stopped concurrently does
+// not get a metadata key without expiration.
+var incrCompletedScript = redigo.NewScript(1, `
+if redis.call('EXISTS', KEYS[1]) == 0 then
+  return 0
+end
+return redis.call('HINCRBY', KEYS[1], ARGV[1], 1)
+`)
+
+// incrCompletedHosts increments the counter of the hosts that completed the
+// query. It must only be called when a targeted host completes the query for
+// the first time.
+func (r *redisLiveQuery) incrCompletedHosts(ctx context.Context, name string) error {
+	metaKey := generateMetaKey(name)
+
+	conn := r.pool.Get()
+	defer conn.Close()
+	if err := redis.BindConn(r.pool, conn, metaKey); err != nil {
+		return fmt.Errorf("bind redis connection: %w", err)
+	}
+	// must come after BindConn due to redisc restrictions
+	conn = redis.ConfigureDoer(r.pool, conn)
+
+	if _, err := scriptDoContext(ctx, incrCompletedScript, conn, metaKey, metaCompleted); err != nil {
+		return fmt.Errorf("increment completed hosts: %w", redisError(err))
+	}
+	return nil
+}
+
+// QueryCompletionStats returns the number of hosts targeted by the live query
+// and the number of those that completed it. Unlike QueryStats, it does not
+// count the bits of the targets, both numbers are counters maintained when the
+// query is started and when a host completes it. The total is 0 if unknown
+// (e.g. the query was started by an older version of Fleet). It returns an
+// error that wraps ErrQueryNotFound if the query does not exist.
+func (r *redisLiveQuery) QueryCompletionStats(ctx context.Context, name string) (total, completed int, err error) {
+	conn := redis.ReadOnlyConn(r.pool, r.pool.Get())
+	defer conn.Close()
+
+	_, sqlKey := generateKeys(name)
+	if err := conn.Send("EXISTS", sqlKey); err != nil {
+		return 0, 0, ctxerr.Wrap(ctx, redisError(err), "check query sql")
+	}
+	if err := conn.Send("HMGET", generateMetaKey(name), metaTargeted, metaCompleted); err != nil {
+		return 0, 0, ctxerr.Wrap(ctx, redisError(err), "get query metadata")
+	}
+	if err := conn.Flush(); err != nil {
+		return 0, 0, ctxerr.Wrap(ctx, redisError(err), "flush pipeline")
+	}
+
+	exists, err := redigo.Bool(receiveContext(ctx, conn))
+	if err != nil {
+		return 0, 0, ctxerr.Wrap(ctx, redisError(err), "receive query sql")
+	}
+	meta, err := redigo.Strings(receiveContext(ctx, conn))
+	if err != nil {
+		return 0, 0, ctxerr.Wrap(ctx, redisError(err), "receive query metadata")
+	}
+	if !exists {
+		return 0, 0, ctxerr.Wrap(ctx, ErrQueryNotFound, "query completion stats")
+	}
+
+	if meta[0] != "" {
+		if total, err = strconv.Atoi(meta[0]); err != nil {
+			return 0, 0, ctxerr.Wrap(ctx, err, "parse targeted hosts")
+		}
+	}
+	if meta[1] != "" {
+		if completed, err = strconv.Atoi(meta[1]); err != nil {
+			return 0, 0, ctxerr.Wrap(ctx, err, "parse completed hosts")
+		}
+	}
+	return total, completed, nil
+}
+
+// QueryStatsBatch returns the statistics of the live queries, by name. The
+// statistics of the queries that share a Redis node are read in a single
+// pipeline. The queries that do not exist are absent from the returned map.
+func (r *redisLiveQuery) QueryStatsBatch(ctx context.Context, names []string) (map[string]*LiveQueryStats, error) {
+	metaKeys := make([]string, 0, len(names))
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		metaKeys = append(metaKeys, generateMetaKey(name))
+	}
+
+	stats := make(map[string]*LiveQueryStats, len(metaKeys))
+	for _, keys := range redis.SplitKeysBySlot(r.pool, metaKeys...) {
+		if err := r.collectBatchQueryStats(keys, stats); err != nil {
+			return nil, ctxerr.Wrap(ctx, err, "collect query stats")
+		}
+	}
+	return stats, nil
+}
+
+func (r *redisLiveQuery) collectBatchQueryStats(metaKeys []string, stats map[string]*LiveQueryStats) error {
+	conn := redis.ReadOnlyConn(r.pool, r.pool.Get())
+	defer conn.Close()
+
+	for _, key := range metaKeys {
+		name := extractMetaKeyName(key)
+		targetKey, sqlKey := generateKeys(name)
+		_, doneKey := generateLazyKeys(name)
+		if err := conn.Send("EXISTS", sqlKey); err != nil {
+			return fmt.Errorf("check query sql: %w", redisError(err))
+		}
+		if err := conn.Send("HMGET", key, metaCreatedAt, metaTargeted, metaChunks, metaLazy, metaLabels); err != nil {
+			return fmt.Errorf("get query metadata: %w", redisError(err))
+		}
+		if err := conn.Send("BITCOUNT", targetKey); err != nil {
+			return fmt.Errorf("count query targets: %w", redisError(err))
+		}
+		if err := conn.Send("SCARD", doneKey); err != nil {
+			return fmt.Errorf("count completed hosts: %w", redisError(err))
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("flush pipeline: %w", redisError(err))
+	}
+
+	// the targets stored in chunks are counted in a second pipeline
+	chunkKeys := make(map[string][]string)
+	for _, key := range metaKeys {
+		name := extractMetaKeyName(key)
+		exists, err := redigo.Bool(conn.Receive())
+		if err != nil {
+			return fmt.Errorf("receive query sql: %w", redisError(err))
+		}
+		meta, err := redigo.Strings(conn.Receive())
+		if err != nil {
+			return fmt.Errorf("receive query metadata: %w", redisError(err))
+		}
+		pending, err := redigo.Int64(conn.Receive())
+		if err != nil {
+			return fmt.Errorf("receive query targets count: %w", redisError(err))
+		}
+		done, err := redigo.Int64(conn.Receive())
+		if err != nil {
+			return fmt.Errorf("receive completed hosts count: %w", redisError(err))
+		}
+		if !exists {
+			continue
+		}
+
+		s := &LiveQueryStats{Name: name, PendingHosts: pending}
+		if meta[0] != "" {
+			nanos, err := strconv.ParseInt(meta[0], 10, 64)
+			if err != nil {
+				return fmt.Errorf("parse creation time: %w", err)
+			}
+			s.CreatedAt = time.Unix(0, nanos)
+		}
+		if meta[1] != "" {
+			if s.TargetedHosts, err = strconv.ParseInt(meta[1], 10, 64); err != nil {
+				return fmt.Errorf("parse targeted hosts: %w", err)
+			}
+		}
+		if chunkKeys[name], err = parseChunkKeys(name, meta[2]); err != nil {
+			return err
+		}
+		// the completed hosts of a lazy query or of a query that targets
+		// labels are in a set that always contains 0 (see sendLazyTargets).
+		if (meta[3] == "1" || meta[4] != "") && done > 0 {
+			s.PendingHosts = max(s.TargetedHosts-(done-1), 0)
+		}
+		stats[name] = s
+	}
+
+	var numChunks int
+	for _, key := range metaKeys {
+		for _, chunkKey := range chunkKeys[extractMetaKeyName(key)] {
+			if err := conn.Send("BITCOUNT", chunkKey); err != nil {
+				return fmt.Errorf("count query targets chunk: %w", redisError(err))
+			}
+			numChunks++
+		}
+	}
+	if numChunks > 0 {
+		if err := conn.Flush(); err != nil {
+			return fmt.Errorf("flush pipeline: %w", redisError(err))
+		}
+		for _, key := range metaKeys {
+			name := extractMetaKeyName(key)
+			for range chunkKeys[name] {
+				n, err := redigo.Int64(conn.Receive())
+				if err != nil {
+					return fmt.Errorf("receive query targets chunk count: %w", redisError(err))
+				}
+				stats[name].PendingHosts += n
+			}
+		}
+	}
+
+	for _, key := range metaKeys {
+		if s := stats[extractMetaKeyName(key)]; s != nil && s.TargetedHosts > 0 {
+			s.CompletedHosts = s.TargetedHosts - s.PendingHosts
+		}
+	}
+	return nil
+}
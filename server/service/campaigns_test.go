@@ -18,26 +18,94 @@ func (nopLiveQuery) RunQuery(name, sql string, hostIDs []uint) error {
 	return nil
 }
 
+func (nopLiveQuery) RunQueryContext(ctx context.Context, name, sql string, hostIDs []uint) error {
+	return nil
+}
+
+func (nopLiveQuery) RunQueries(ctx context.Context, queries []fleet.LiveQuerySpec) error {
+	return nil
+}
+
+func (nopLiveQuery) RunQueryWithTTL(ctx context.Context, name, sql string, hostIDs []uint, ttl time.Duration) error {
+	return nil
+}
+
+func (nopLiveQuery) RunQueryWithPriority(ctx context.Context, name, sql string, hostIDs []uint, priority int) error {
+	return nil
+}
+
+func (nopLiveQuery) ReplaceQuery(ctx context.Context, name, sql string, hostIDs []uint) error {
+	return nil
+}
+
 func (nopLiveQuery) StopQuery(name string) error {
 	return nil
 }
 
+func (nopLiveQuery) StopQueries(ctx context.Context, names []string) error {
+	return nil
+}
+
 func (nopLiveQuery) QueriesForHost(hostID uint) (map[string]string, error) {
 	return map[string]string{}, nil
 }
 
+func (nopLiveQuery) QueriesForHostPlatform(hostID uint, hostPlatform string) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
+func (nopLiveQuery) QueriesForHostWithMeta(hostID uint) (map[string]fleet.LiveQueryInfo, error) {
+	return map[string]fleet.LiveQueryInfo{}, nil
+}
+
+func (nopLiveQuery) QueriesForHosts(ctx context.Context, hostIDs []uint) (map[uint]map[string]string, error) {
+	return map[uint]map[string]string{}, nil
+}
+
 func (nopLiveQuery) QueryCompletedByHost(name string, hostID uint) error {
 	return nil
 }
 
+func (nopLiveQuery) QueryCompletedByHostContext(ctx context.Context, name string, hostID uint) error {
+	return nil
+}
+
+func (nopLiveQuery) QueryCompletionStats(ctx context.Context, name string) (total, completed int, err error) {
+	return 0, 0, nil
+}
+
+func (nopLiveQuery) ResetHostQueries(ctx context.Context, hostID uint) error {
+	return nil
+}
+
+func (nopLiveQuery) PendingHostsForQuery(ctx context.Context, name string) ([]uint, error) {
+	return nil, nil
+}
+
 func (nopLiveQuery) CleanupInactiveQueries(ctx context.Context, inactiveCampaignIDs []uint) error {
 	return nil
 }
 
+func (nopLiveQuery) CleanupInactiveQueriesDryRun(ctx context.Context, activeCampaignIDs []uint) ([]string, error) {
+	return nil, nil
+}
+
+func (nopLiveQuery) RepairActiveQueries(ctx context.Context) ([]string, []string, error) {
+	return nil, nil, nil
+}
+
 func (q nopLiveQuery) LoadActiveQueryNames() ([]string, error) {
 	return nil, nil
 }
 
+func (nopLiveQuery) ActiveQueryNames(ctx context.Context) ([]string, error) {
+	return nil, nil
+}
+
+func (nopLiveQuery) QueryExists(ctx context.Context, name string) (bool, error) {
+	return false, nil
+}
+
 func TestLiveQueryAuth(t *testing.T) {
 	ds := new(mock.Store)
 	qr := pubsub.NewInmemQueryResults()
@@ -37,6 +37,7 @@ import (
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 	"gopkg.in/guregu/null.v3"
@@ -124,7 +125,7 @@ func (s *integrationTestSuite) TestDistributedReadWithChangedQueries() {
 	})
 	require.NoError(t, err)
 
-	s.lq.On("QueriesForHost", host.ID).Return(map[string]string{fmt.Sprintf("%d", host.ID): "SELECT 1 FROM osquery;"}, nil)
+	s.lq.On("QueriesForHostPlatform", host.ID, mock.Anything).Return(map[string]string{fmt.Sprintf("%d", host.ID): "SELECT 1 FROM osquery;"}, nil)
 
 	// Ensure we can read distributed queries for the host.
 	err = s.ds.UpdateHostRefetchRequested(context.Background(), host.ID, true)
@@ -3757,7 +3757,7 @@ func (s *integrationEnterpriseTestSuite) TestDistributedReadWithFeatures() {
 	})
 	require.NoError(t, err)
 
-	s.lq.On("QueriesForHost", host.ID).Return(map[string]string{fmt.Sprintf("%d", host.ID): "select 1 from osquery;"}, nil)
+	s.lq.On("QueriesForHostPlatform", host.ID, mock.Anything).Return(map[string]string{fmt.Sprintf("%d", host.ID): "select 1 from osquery;"}, nil)
 
 	// ensure we can read distributed queries for the host
 	err = s.ds.UpdateHostRefetchRequested(context.Background(), host.ID, true)
@@ -7744,7 +7744,7 @@ func (s *integrationEnterpriseTestSuite) TestTeamConfigDetailQueriesOverrides()
 	require.NoError(t, err)
 
 	// get distributed queries for the host
-	s.lq.On("QueriesForHost", linuxHost.ID).Return(map[string]string{t.Name(): "select 1 from osquery;"}, nil)
+	s.lq.On("QueriesForHostPlatform", linuxHost.ID, mock.Anything).Return(map[string]string{t.Name(): "select 1 from osquery;"}, nil)
 	req := getDistributedQueriesRequest{NodeKey: *linuxHost.NodeKey}
 	var dqResp getDistributedQueriesResponse
 	s.DoJSON("POST", "/api/osquery/distributed/read", req, http.StatusOK, &dqResp)
@@ -119,7 +119,7 @@ func (s *liveQueriesTestSuite) TestLiveQueriesRestOneHostOneQuery() {
 		)
 		require.NoError(t, err)
 
-		s.lq.On("QueriesForHost", uint(1)).Return(map[string]string{fmt.Sprint(q1.ID): query}, nil)
+		s.lq.On("QueriesForHostPlatform", uint(1), mock.Anything).Return(map[string]string{fmt.Sprint(q1.ID): query}, nil)
 		s.lq.On("QueryCompletedByHost", mock.Anything, mock.Anything).Return(nil)
 		s.lq.On("RunQuery", mock.Anything, query, []uint{host.ID}).Return(nil)
 		s.lq.On("StopQuery", mock.Anything).Return(nil)
@@ -359,7 +359,7 @@ func (s *liveQueriesTestSuite) TestLiveQueriesRestOneHostMultipleQuery() {
 	})
 	require.NoError(t, err)
 
-	s.lq.On("QueriesForHost", host.ID).Return(map[string]string{
+	s.lq.On("QueriesForHostPlatform", host.ID, mock.Anything).Return(map[string]string{
 		fmt.Sprint(q1.ID): "select 1 from osquery;",
 		fmt.Sprint(q2.ID): "select 2 from osquery;",
 	}, nil)
@@ -472,11 +472,11 @@ func (s *liveQueriesTestSuite) TestLiveQueriesRestMultipleHostMultipleQuery() {
 	})
 	require.NoError(t, err)
 
-	s.lq.On("QueriesForHost", h1.ID).Return(map[string]string{
+	s.lq.On("QueriesForHostPlatform", h1.ID, mock.Anything).Return(map[string]string{
 		fmt.Sprint(q1.ID): "select 1 from osquery;",
 		fmt.Sprint(q2.ID): "select 2 from osquery;",
 	}, nil)
-	s.lq.On("QueriesForHost", h2.ID).Return(map[string]string{
+	s.lq.On("QueriesForHostPlatform", h2.ID, mock.Anything).Return(map[string]string{
 		fmt.Sprint(q1.ID): "select 1 from osquery;",
 		fmt.Sprint(q2.ID): "select 2 from osquery;",
 	}, nil)
@@ -585,7 +585,7 @@ func (s *liveQueriesTestSuite) TestLiveQueriesSomeFailToAuthorize() {
 	)
 	require.NoError(t, err)
 
-	s.lq.On("QueriesForHost", uint(1)).Return(map[string]string{fmt.Sprint(q1.ID): "select 2 from osquery;"}, nil)
+	s.lq.On("QueriesForHostPlatform", uint(1), mock.Anything).Return(map[string]string{fmt.Sprint(q1.ID): "select 2 from osquery;"}, nil)
 	s.lq.On("QueryCompletedByHost", mock.Anything, mock.Anything).Return(nil)
 	s.lq.On("RunQuery", mock.Anything, "select 2 from osquery;", []uint{host.ID}).Return(nil)
 	s.lq.On("StopQuery", mock.Anything).Return(nil)
@@ -833,8 +833,8 @@ func (s *liveQueriesTestSuite) TestLiveQueriesRestFailsOnSomeHost() {
 		)
 		require.NoError(t, err)
 
-		s.lq.On("QueriesForHost", h1.ID).Return(map[string]string{fmt.Sprint(q1.ID): "select 1 from osquery;"}, nil)
-		s.lq.On("QueriesForHost", h2.ID).Return(map[string]string{fmt.Sprint(q1.ID): "select 1 from osquery;"}, nil)
+		s.lq.On("QueriesForHostPlatform", h1.ID, mock.Anything).Return(map[string]string{fmt.Sprint(q1.ID): "select 1 from osquery;"}, nil)
+		s.lq.On("QueriesForHostPlatform", h2.ID, mock.Anything).Return(map[string]string{fmt.Sprint(q1.ID): "select 1 from osquery;"}, nil)
 		s.lq.On("QueryCompletedByHost", mock.Anything, mock.Anything).Return(nil)
 		s.lq.On("RunQuery", mock.Anything, "select 1 from osquery;", []uint{h1.ID, h2.ID}).Return(nil)
 		s.lq.On("StopQuery", mock.Anything).Return(nil)
@@ -1027,7 +1027,7 @@ func (s *liveQueriesTestSuite) TestOsqueryDistributedRead() {
 	t := s.T()
 
 	hostID := s.hosts[1].ID
-	s.lq.On("QueriesForHost", hostID).Return(map[string]string{fmt.Sprintf("%d", hostID): "select 1 from osquery;"}, nil)
+	s.lq.On("QueriesForHostPlatform", hostID, mock.Anything).Return(map[string]string{fmt.Sprintf("%d", hostID): "select 1 from osquery;"}, nil)
 
 	req := getDistributedQueriesRequest{NodeKey: *s.hosts[1].NodeKey}
 	var resp getDistributedQueriesResponse
@@ -1081,7 +1081,7 @@ func (s *liveQueriesTestSuite) TestOsqueryDistributedReadWithFeatures() {
 	})
 	require.NoError(t, err)
 
-	s.lq.On("QueriesForHost", host.ID).Return(map[string]string{fmt.Sprintf("%d", host.ID): "select 1 from osquery;"}, nil)
+	s.lq.On("QueriesForHostPlatform", host.ID, mock.Anything).Return(map[string]string{fmt.Sprintf("%d", host.ID): "select 1 from osquery;"}, nil)
 
 	err = s.ds.UpdateHostRefetchRequested(context.Background(), host.ID, true)
 	require.NoError(t, err)
@@ -625,11 +625,11 @@ func (svc *Service) GetDistributedQueries(ctx context.Context) (queries map[stri
 		queries[hostLabelQueryPrefix+name] = query
 	}
 
-	if liveQueries, err := svc.liveQueryStore.QueriesForHost(host.ID); err != nil {
+	if liveQueries, err := svc.liveQueryStore.QueriesForHostPlatform(host.ID, host.Platform); err != nil {
 		// If the live query store fails to fetch queries we still want the hosts
 		// to receive all the other queries (details, policies, labels, etc.),
 		// thus we just log the error.
-		level.Error(svc.logger).Log("op", "QueriesForHost", "err", err)
+		level.Error(svc.logger).Log("op", "QueriesForHostPlatform", "err", err)
 	} else {
 		for name, query := range liveQueries {
 			queries[hostDistributedQueryPrefix+name] = query
@@ -37,6 +37,7 @@ import (
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/stretchr/testify/assert"
+	tmock "github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 )
 
@@ -1231,9 +1232,9 @@ func TestQueriesAndHostFeatures(t *testing.T) {
 	}
 
 	lq := live_query_mock.New(t)
-	lq.On("QueriesForHost", uint(1)).Return(map[string]string{}, nil)
-	lq.On("QueriesForHost", uint(2)).Return(map[string]string{}, nil)
-	lq.On("QueriesForHost", nil).Return(map[string]string{}, nil)
+	lq.On("QueriesForHostPlatform", uint(1), tmock.Anything).Return(map[string]string{}, nil)
+	lq.On("QueriesForHostPlatform", uint(2), tmock.Anything).Return(map[string]string{}, nil)
+	lq.On("QueriesForHostPlatform", nil, tmock.Anything).Return(map[string]string{}, nil)
 
 	t.Run("free license", func(t *testing.T) {
 		license := &fleet.LicenseInfo{Tier: fleet.TierFree}
@@ -1331,7 +1332,7 @@ func TestGetDistributedQueriesEmptyQuery(t *testing.T) {
 		return map[string]string{"empty_policy_query": ""}, nil
 	}
 
-	lq.On("QueriesForHost", uint(0)).Return(map[string]string{"empty_live_query": ""}, nil)
+	lq.On("QueriesForHostPlatform", uint(0), tmock.Anything).Return(map[string]string{"empty_live_query": ""}, nil)
 
 	ctx = hostctx.NewContext(ctx, host)
 	queries, discovery, _, err := svc.GetDistributedQueries(ctx)
@@ -1375,7 +1376,7 @@ func TestLabelQueries(t *testing.T) {
 		return map[string]string{}, nil
 	}
 
-	lq.On("QueriesForHost", uint(0)).Return(map[string]string{}, nil)
+	lq.On("QueriesForHostPlatform", uint(0), tmock.Anything).Return(map[string]string{}, nil)
 
 	ctx = hostctx.NewContext(ctx, host)
 
@@ -1544,12 +1545,14 @@ func TestDetailQueriesWithEmptyStrings(t *testing.T) {
 		return host, nil
 	}
 
-	lq.On("QueriesForHost", host.ID).Return(map[string]string{}, nil)
+	lq.On("QueriesForHostPlatform", host.ID, tmock.Anything).Return(map[string]string{}, nil)
 
 	// With a new host, we should get the detail queries (and accelerated
 	// queries)
 	queries, discovery, acc, err := svc.GetDistributedQueries(ctx)
 	require.NoError(t, err)
+	// the live queries are read for the platform of the host
+	lq.AssertCalled(t, "QueriesForHostPlatform", host.ID, "windows")
 	// +1 due to 'windows_update_history', +1 due to fleet_no_policies_wildcard query.
 	if expected := expectedDetailQueriesForPlatform(host.Platform); !assert.Equal(t, len(expected)+1+1, len(queries)) {
 		// this is just to print the diff between the expected and actual query
@@ -1718,7 +1721,7 @@ func TestDetailQueries(t *testing.T) {
 	}
 	ctx = hostctx.NewContext(ctx, host)
 
-	lq.On("QueriesForHost", host.ID).Return(map[string]string{}, nil)
+	lq.On("QueriesForHostPlatform", host.ID, tmock.Anything).Return(map[string]string{}, nil)
 
 	ds.AppConfigFunc = func(ctx context.Context) (*fleet.AppConfig, error) {
 		return &fleet.AppConfig{Features: fleet.Features{
@@ -2230,7 +2233,7 @@ func TestDistributedQueryResults(t *testing.T) {
 
 	hostCtx := hostctx.NewContext(ctx, host)
 
-	lq.On("QueriesForHost", uint(1)).Return(
+	lq.On("QueriesForHostPlatform", uint(1), tmock.Anything).Return(
 		map[string]string{
 			fmt.Sprint(campaign.ID): "select * from time",
 		},
@@ -3095,7 +3098,7 @@ func TestPolicyQueries(t *testing.T) {
 		}}, nil
 	}
 
-	lq.On("QueriesForHost", uint(0)).Return(map[string]string{}, nil)
+	lq.On("QueriesForHostPlatform", uint(0), tmock.Anything).Return(map[string]string{}, nil)
 
 	ds.PolicyQueriesForHostFunc = func(ctx context.Context, host *fleet.Host) (map[string]string, error) {
 		return map[string]string{"1": "select 1", "2": "select 42;"}, nil
@@ -3275,7 +3278,7 @@ func TestPolicyWebhooks(t *testing.T) {
 		Hostname: "test.hostname",
 	}
 
-	lq.On("QueriesForHost", uint(5)).Return(map[string]string{}, nil)
+	lq.On("QueriesForHostPlatform", uint(5), tmock.Anything).Return(map[string]string{}, nil)
 	ds.LabelQueriesForHostFunc = func(ctx context.Context, host *fleet.Host) (map[string]string, error) {
 		return map[string]string{}, nil
 	}
@@ -3546,7 +3549,7 @@ func TestLiveQueriesFailing(t *testing.T) {
 		ID:       hostID,
 		Platform: "darwin",
 	}
-	lq.On("QueriesForHost", hostID).Return(
+	lq.On("QueriesForHostPlatform", hostID, tmock.Anything).Return(
 		map[string]string{},
 		errors.New("failed to get queries for host"),
 	)
@@ -25,6 +25,7 @@ import (
 	kitlog "github.com/go-kit/log"
 	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
+	tmock "github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 )
 
@@ -78,7 +79,7 @@ func TestStreamCampaignResultsClosesReditOnWSClose(t *testing.T) {
 
 	host := &fleet.Host{ID: 1, Platform: "windows"}
 
-	lq.On("QueriesForHost", uint(1)).Return(
+	lq.On("QueriesForHostPlatform", uint(1), tmock.Anything).Return(
 		map[string]string{
 			strconv.Itoa(int(campaign.ID)): "select * from time",
 		},